@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -22,6 +23,11 @@ type DataProvider interface {
 	Shrink()
 }
 
+// HealthChecker optional for data providers, CheckHealth panics when the session store is not usable
+type HealthChecker interface {
+	CheckHealth(ctx context.Context)
+}
+
 type SessionsConfig struct {
 	Secret       *string `json:"secret"`
 	TokenTimeout *int    `json:"tokenTimeout"`
@@ -52,6 +58,7 @@ type SessionManager struct {
 	JwtConfig    SessionsConfig
 	SessionMap   map[string]*SessionEntry
 	Mux          sync.Mutex
+	maintenance  chan struct{}
 }
 
 func (o *SessionsConfig) Validate() {
@@ -146,6 +153,57 @@ func (o *SessionManager) Shrink() {
 	o.DataProvider.Shrink()
 }
 
+// StartMaintenance shrinks the session store periodically until StopMaintenance is called
+func (o *SessionManager) StartMaintenance(interval time.Duration) {
+	o.Mux.Lock()
+	defer o.Mux.Unlock()
+	if o.maintenance != nil {
+		return
+	}
+	done := make(chan struct{})
+	o.maintenance = done
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.safeShrink()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (o *SessionManager) safeShrink() {
+	defer util.CatchPanic()
+	o.Shrink()
+}
+
+func (o *SessionManager) StopMaintenance() {
+	o.Mux.Lock()
+	defer o.Mux.Unlock()
+	if o.maintenance != nil {
+		close(o.maintenance)
+		o.maintenance = nil
+	}
+}
+
+// CheckHealth panics when the data provider reports its store unusable, providers not implementing
+// HealthChecker are assumed healthy
+func (o *SessionManager) CheckHealth(ctx context.Context) {
+	if checker, ok := o.DataProvider.(HealthChecker); ok {
+		checker.CheckHealth(ctx)
+	}
+}
+
+// HealthCheckable whether the data provider implements HealthChecker
+func (o *SessionManager) HealthCheckable() bool {
+	_, ok := o.DataProvider.(HealthChecker)
+	return ok
+}
+
 func (o *SessionManager) Load() {
 	o.SessionMap = o.DataProvider.LoadSnapshot()
 }
@@ -2,6 +2,7 @@ package coverage
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -96,10 +97,63 @@ func NewHttpClient(serveMux *http.ServeMux) *HttpClient {
 	}
 }
 
-func StartHttpServer(serveMux *http.ServeMux, httpPort int) *http.Server {
-	serveMux.HandleFunc("/coverage/ping", func(writer http.ResponseWriter, request *http.Request) {
+// handleLiveness serves web.HealthLivePath for the warm up probes unless the application already configured it
+func handleLiveness(serveMux *http.ServeMux) {
+	if _, pattern := serveMux.Handler(httptest.NewRequest(http.MethodGet, web.HealthLivePath, nil)); pattern == web.HealthLivePath {
+		return
+	}
+	serveMux.HandleFunc(web.HealthLivePath, func(writer http.ResponseWriter, request *http.Request) {
 
 	})
+}
+
+// StartHttpsServer same as StartHttpServer over TLS, the warm up probe skips certificate verification
+func StartHttpsServer(serveMux *http.ServeMux, httpPort int, tlsConfig web.TlsConfig) *http.Server {
+	handleLiveness(serveMux)
+	localAddress := fmt.Sprintf(":%d", httpPort)
+	util.Log("info").Println("Starting https server at " + localAddress)
+	reloader := web.NewCertificateReloader(tlsConfig)
+	httpServer := &http.Server{Addr: localAddress, Handler: web.InterceptClientCertificate(serveMux), TLSConfig: reloader.TlsConfig()}
+	httpServer.RegisterOnShutdown(reloader.Stop)
+	go func() {
+		httpServer.SetKeepAlivesEnabled(false)
+		err := httpServer.ListenAndServeTLS("", "")
+		if err != http.ErrServerClosed {
+			util.CheckErr(err)
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Timeout:   time.Second,
+	}
+	probe := func() (result bool) {
+		result = false
+		defer util.CatchPanic()
+		response, err := client.Get(fmt.Sprintf("https://localhost:%d%s", httpPort, web.HealthLivePath))
+		util.CheckErr(err)
+		defer web.CloseResponse(response)
+		web.CheckResponse(response, 200)
+		return true
+	}
+
+	n := 0
+	for {
+		if probe() {
+			break
+		}
+		time.Sleep(time.Millisecond * 500)
+		n++
+		if n == 3 {
+			panic("Https server warm up probe failed")
+		}
+	}
+
+	return httpServer
+}
+
+func StartHttpServer(serveMux *http.ServeMux, httpPort int) *http.Server {
+	handleLiveness(serveMux)
 	localAddress := fmt.Sprintf(":%d", httpPort)
 	util.Log("info").Println("Starting http server at " + localAddress)
 	httpServer := &http.Server{Addr: localAddress, Handler: serveMux}
@@ -114,7 +168,7 @@ func StartHttpServer(serveMux *http.ServeMux, httpPort int) *http.Server {
 	probe := func() (result bool) {
 		result = false
 		defer util.CatchPanic()
-		web.Get(fmt.Sprintf("http://localhost:%d/coverage/ping", httpPort), time.Second, 200, nil)
+		web.Get(fmt.Sprintf("http://localhost:%d%s", httpPort, web.HealthLivePath), time.Second, 200, nil)
 		return true
 	}
 
@@ -27,6 +27,16 @@ func (o *ResponseWriter) Write(b []byte) (int, error) {
 	}
 }
 
+func (o *ResponseWriter) Flush() {
+	if !o.notFound {
+		_ = http.NewResponseController(o.ResponseWriter).Flush()
+	}
+}
+
+func (o *ResponseWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
 func InterceptReact(folder string, h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		interceptor := ResponseWriter{ResponseWriter: w, notFound: false}
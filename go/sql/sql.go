@@ -2,11 +2,14 @@ package sql
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -62,8 +65,71 @@ func (o *Databases) CloseDB(datasourceConfig DatasourceConfig) {
 	}
 }
 
+// CloseAll closes every open database, waiting for the connections in use to be released
+func (o *Databases) CloseAll() {
+	o.mux.Lock()
+	dbs := o.dbMap
+	o.dbMap = make(map[string]*sql.DB)
+	o.mux.Unlock()
+	for _, db := range dbs {
+		CloseDB(db)
+	}
+}
+
+// Stats reports the pool statistics of every open database, keyed by driver and datasource
+// name with credentials removed
+func (o *Databases) Stats() map[string]sql.DBStats {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	result := make(map[string]sql.DBStats, len(o.dbMap))
+	for k, db := range o.dbMap {
+		result[redactDatasourceName(k)] = db.Stats()
+	}
+	return result
+}
+
+// Ping pings every open database concurrently, keyed as in Stats. A nil error means the database answered.
+func (o *Databases) Ping(ctx context.Context) map[string]error {
+	o.mux.Lock()
+	dbs := make(map[string]*sql.DB, len(o.dbMap))
+	for k, db := range o.dbMap {
+		dbs[redactDatasourceName(k)] = db
+	}
+	o.mux.Unlock()
+	result := make(map[string]error, len(dbs))
+	resultMux := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for k, db := range dbs {
+		wg.Add(1)
+		go func(k string, db *sql.DB) {
+			defer wg.Done()
+			err := db.PingContext(ctx)
+			resultMux.Lock()
+			defer resultMux.Unlock()
+			result[k] = err
+		}(k, db)
+	}
+	wg.Wait()
+	return result
+}
+
 var GlobalDatabases = &Databases{dbMap: make(map[string]*sql.DB), mux: &sync.Mutex{}}
 
+// redactDatasourceName removes passwords from url (postgres://user:pw@host/db) and key=value
+// (user=x password=y) datasource names
+func redactDatasourceName(name string) string {
+	if u, err := url.Parse(name); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	fields := strings.Fields(name)
+	for i, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f), "password=") {
+			fields[i] = "password=xxxxx"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
 func CloseDB(db *sql.DB) {
 	util.ProcessError(db.Close())
 }
@@ -1,11 +1,13 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,6 +46,11 @@ type LogWriter struct {
 	mux         *sync.Mutex
 }
 
+// NewLogWriter files are named fileName.1 to fileName.<maxFiles-1>, rotated after maxSize bytes
+func NewLogWriter(fileName string, maxSize int, maxFiles int) *LogWriter {
+	return &LogWriter{FileName: fileName, MaxSize: maxSize, MaxFiles: maxFiles, mux: &sync.Mutex{}}
+}
+
 func (o *LogWriter) Write(p []byte) (n int, err error) {
 	o.initialize()
 	o.mux.Lock()
@@ -64,6 +71,16 @@ func (o *LogWriter) Write(p []byte) (n int, err error) {
 	return w, nil
 }
 
+// Sync commits the current file to disk
+func (o *LogWriter) Sync() error {
+	if !o.initialized.Load() {
+		return nil
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.file.Sync()
+}
+
 func (o *LogWriter) initialize() {
 	if o.initialized.Load() {
 		return
@@ -126,25 +143,31 @@ func (o *NullWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Loggers loggerMap is replaced, never modified, so tags can be toggled while other goroutines log
 type Loggers struct {
+	writer     *LogWriter
 	output     io.Writer
-	loggerMap  map[string]*log.Logger
+	flags      int
+	loggerMap  atomic.Pointer[map[string]*log.Logger]
 	nullLogger *log.Logger
+	mux        sync.Mutex
 }
 
 func (o *Loggers) Config(fileName string, maxSize int, maxFiles int, console bool, logFlags int, tags ...string) {
-	w := LogWriter{FileName: fileName, MaxFiles: maxFiles, MaxSize: maxSize, mux: &sync.Mutex{}}
+	w := NewLogWriter(fileName, maxSize, maxFiles)
+	o.writer = w
 	if console {
-		o.output = io.MultiWriter(&w, os.Stdout)
+		o.output = io.MultiWriter(w, os.Stdout)
 		log.SetOutput(o.output)
 	} else {
-		o.output = &w
-		log.SetOutput(&w)
+		o.output = w
+		log.SetOutput(w)
 	}
-	o.loggerMap = make(map[string]*log.Logger)
+	o.flags = logFlags
+	loggerMap := make(map[string]*log.Logger)
 	for i := range tags {
 		prefix := tags[i]
-		o.loggerMap[prefix] = log.New(o.output, prefix+": ", logFlags)
+		loggerMap[prefix] = log.New(o.output, prefix+": ", logFlags)
 	}
 	nullWriter := NullWriter{}
 	//nullLogger := log.New(&nullWriter, "", 0)
@@ -153,29 +176,143 @@ func (o *Loggers) Config(fileName string, maxSize int, maxFiles int, console boo
 	nullLogger.SetPrefix("")
 	nullLogger.SetFlags(0)
 	o.nullLogger = &nullLogger
+	o.loggerMap.Store(&loggerMap)
 }
 
 func (o *Loggers) Log(prefix string) *log.Logger {
-	if o.loggerMap == nil {
+	loggerMap := o.loggerMap.Load()
+	if loggerMap == nil {
 		return defaultLogger
-	} else if l, ok := o.loggerMap[prefix]; ok {
+	} else if l, ok := (*loggerMap)[prefix]; ok {
 		return l
 	} else {
 		return o.nullLogger
 	}
 }
 
+// Tags the enabled tags, sorted
+func (o *Loggers) Tags() []string {
+	loggerMap := o.loggerMap.Load()
+	if loggerMap == nil {
+		return []string{}
+	}
+	tags := make([]string, 0, len(*loggerMap))
+	for tag := range *loggerMap {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// SetTag enables or disables tag at runtime, loggers must have been configured
+func (o *Loggers) SetTag(tag string, enabled bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	current := o.loggerMap.Load()
+	if current == nil {
+		panic("Loggers not configured")
+	}
+	loggerMap := make(map[string]*log.Logger, len(*current)+1)
+	for k, v := range *current {
+		loggerMap[k] = v
+	}
+	if enabled {
+		if _, ok := loggerMap[tag]; !ok {
+			loggerMap[tag] = log.New(o.output, tag+": ", o.flags)
+		}
+	} else {
+		delete(loggerMap, tag)
+	}
+	o.loggerMap.Store(&loggerMap)
+}
+
+func (o *Loggers) Flush() {
+	if o.writer != nil {
+		err := o.writer.Sync()
+		if err != nil {
+			defaultLogger.Printf("Could not flush log file: %v", err)
+		}
+	}
+}
+
+// Reset back to the state before Config, logging to the standard logger
+func (o *Loggers) Reset() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.Flush()
+	o.loggerMap.Store(nil)
+	o.writer = nil
+	o.output = nil
+	log.SetOutput(os.Stderr)
+}
+
 var loggers Loggers
 
 func ConfigLoggers(fileName string, maxSize int, maxFiles int, console bool, flags int, tags ...string) {
 	loggers.Config(fileName, maxSize, maxFiles, console, flags, tags...)
 }
 
+// LogFileName the base name of the log files, empty when ConfigLoggers was not called
+func LogFileName() string {
+	if loggers.writer == nil {
+		return ""
+	}
+	return loggers.writer.FileName
+}
+
+func ResetLoggers() {
+	loggers.Reset()
+}
+
+func LogTags() []string {
+	return loggers.Tags()
+}
+
+func SetLogTag(tag string, enabled bool) {
+	loggers.SetTag(tag, enabled)
+}
+
+func FlushLoggers() {
+	loggers.Flush()
+}
+
 func Log(tag string) *log.Logger {
 	return loggers.Log(tag)
 }
 
+type contextKey string
+
+const correlationIdContextKey = contextKey("correlationId")
+
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, correlationIdContextKey, correlationId)
+}
+
+func CorrelationId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if v, ok := ctx.Value(correlationIdContextKey).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// LogContext same as Log but lines are prefixed with the correlation id found in ctx, if any
+func LogContext(ctx context.Context, tag string) *log.Logger {
+	l := Log(tag)
+	correlationId := CorrelationId(ctx)
+	if correlationId == "" || (loggers.loggerMap.Load() != nil && !Loggable(tag)) {
+		return l
+	}
+	return log.New(l.Writer(), l.Prefix()+"["+correlationId+"] ", l.Flags())
+}
+
 func Loggable(tag string) bool {
-	_, ok := loggers.loggerMap[tag]
+	loggerMap := loggers.loggerMap.Load()
+	if loggerMap == nil {
+		return false
+	}
+	_, ok := (*loggerMap)[tag]
 	return ok
 }
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -183,10 +184,15 @@ func CatchPanic() {
 }
 
 func ProcessError(intf any, logTag ...string) {
+	ProcessErrorContext(context.Background(), intf, logTag...)
+}
+
+// ProcessErrorContext same as ProcessError, log lines carry the correlation id found in ctx
+func ProcessErrorContext(ctx context.Context, intf any, logTag ...string) {
 	if len(logTag) > 0 {
-		processErrorEx(intf, &logTag[0], nil)
+		processErrorEx(ctx, intf, &logTag[0], nil)
 	} else {
-		processErrorEx(intf, nil, nil)
+		processErrorEx(ctx, intf, nil, nil)
 	}
 }
 
@@ -236,9 +242,9 @@ func doProcessErrorCompact(e any, category string, obsolescence time.Duration) {
 	key := buffer.String()
 	now := time.Now()
 	if putError(key, now, obsolescence) {
-		processErrorEx(e, nil, &defaultStackTraceTag)
+		processErrorEx(context.Background(), e, nil, &defaultStackTraceTag)
 	} else {
-		processErrorEx(e, nil, &noStackTraceTag)
+		processErrorEx(context.Background(), e, nil, &noStackTraceTag)
 	}
 }
 
@@ -261,7 +267,7 @@ func putError(key string, now time.Time, obsolescence time.Duration) bool {
 }
 
 // sick and tired of not having the stack traces when I need them, banning this for now, removing soon
-func processErrorEx(e any, logTag *string, stackTraceTag *string) {
+func processErrorEx(ctx context.Context, e any, logTag *string, stackTraceTag *string) {
 	if e == nil {
 		return
 	}
@@ -275,12 +281,12 @@ func processErrorEx(e any, logTag *string, stackTraceTag *string) {
 	message := ResolveErrorMessage(e)
 	if tag == *stackTraceTag || Loggable(*stackTraceTag) {
 		stackTrace := string(debug.Stack())
-		Log(*stackTraceTag).Printf("%s\n%s", message, stackTrace)
+		LogContext(ctx, *stackTraceTag).Printf("%s\n%s", message, stackTrace)
 	} else if Loggable(*stackTraceTag) {
 		stackTrace := string(debug.Stack())
-		Log(*stackTraceTag).Printf("%s\n%s", message, stackTrace)
+		LogContext(ctx, *stackTraceTag).Printf("%s\n%s", message, stackTrace)
 	} else {
-		Log(tag).Printf("%s", message)
+		LogContext(ctx, tag).Printf("%s", message)
 	}
 }
 
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJson     = "json"
+)
+
+type AccessLogConfig struct {
+	FileName     *string  `json:"fileName"`
+	MaxSize      *int     `json:"maxSize"`
+	MaxFiles     *int     `json:"maxFiles"`
+	Format       *string  `json:"format"`
+	SampleRate   *float64 `json:"sampleRate"`
+	ExcludePaths []string `json:"excludePaths"`
+}
+
+func DefaultAccessLogConfig(fileName string) AccessLogConfig {
+	return AccessLogConfig{
+		FileName:   &fileName,
+		MaxSize:    util.PInt(100 * 1024 * 1024),
+		MaxFiles:   util.PInt(10),
+		Format:     util.PStr(AccessLogCombined),
+		SampleRate: util.PFloat64(1),
+	}
+}
+
+func (o *AccessLogConfig) Validate() {
+	if o.FileName == nil || *o.FileName == "" {
+		panic("Invalid fileName")
+	}
+	if o.MaxSize == nil || *o.MaxSize <= 0 {
+		panic("Invalid maxSize")
+	}
+	if o.MaxFiles == nil || *o.MaxFiles < 2 {
+		panic("Invalid maxFiles")
+	}
+	if o.Format == nil || (*o.Format != AccessLogCombined && *o.Format != AccessLogJson) {
+		panic("Invalid format")
+	}
+	if o.SampleRate == nil || *o.SampleRate <= 0 || *o.SampleRate > 1 {
+		panic("Invalid sampleRate")
+	}
+}
+
+// excludes entries match the path or the route pattern, a trailing * matches a prefix
+func (o *AccessLogConfig) excludes(path string, route string) bool {
+	for _, excluded := range o.ExcludePaths {
+		if prefix, ok := strings.CutSuffix(excluded, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if excluded == path || excluded == route {
+			return true
+		}
+	}
+	return false
+}
+
+type accessLogger struct {
+	config AccessLogConfig
+	writer io.Writer
+}
+
+var accessLog *accessLogger
+
+// ConfigureAccessLog enables the access log for every handler going through InterceptFatal or InterceptStats.
+// Sampling applies to successful requests only, responses with status >= 400 are always written.
+func ConfigureAccessLog(config AccessLogConfig) {
+	config.Validate()
+	accessLog = &accessLogger{config: config, writer: util.NewLogWriter(*config.FileName, *config.MaxSize, *config.MaxFiles)}
+}
+
+// resetAccessLog flushes and disables the access log
+func resetAccessLog() {
+	flushAccessLog()
+	accessLog = nil
+}
+
+func flushAccessLog() {
+	if accessLog == nil {
+		return
+	}
+	if w, ok := accessLog.writer.(*util.LogWriter); ok {
+		if err := w.Sync(); err != nil {
+			util.Log("warning").Printf("Could not flush access log: %v", err)
+		}
+	}
+}
+
+// requestInfo filled in by the inner interceptors for the outer ones, request contexts only travel inwards
+type requestInfo struct {
+	user string
+}
+
+func withRequestInfo(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "requestInfo", &requestInfo{}))
+}
+
+// setRequestUser records the authenticated user id, basic auth username or signing client id
+func setRequestUser(r *http.Request, user string) {
+	if info, ok := r.Context().Value("requestInfo").(*requestInfo); ok {
+		info.user = user
+	}
+}
+
+func requestUser(r *http.Request) string {
+	if info, ok := r.Context().Value("requestInfo").(*requestInfo); ok {
+		return info.user
+	}
+	return ""
+}
+
+type accessLogEntry struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Route         string    `json:"route"`
+	Uri           string    `json:"uri"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	Bytes         int64     `json:"bytes"`
+	Duration      float64   `json:"durationMs"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	User          string    `json:"user,omitempty"`
+	CorrelationId string    `json:"correlationId,omitempty"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+}
+
+func (o *accessLogger) record(w *statsWriter, r *http.Request, t0 time.Time, d time.Duration) {
+	route := routeKey(r)
+	if o.config.excludes(r.URL.Path, route) {
+		return
+	}
+	status := w.Status()
+	if status < http.StatusBadRequest && *o.config.SampleRate < 1 && rand.Float64() >= *o.config.SampleRate {
+		return
+	}
+	correlationId := w.Header().Get(CorrelationIdHeaderName)
+	if correlationId == "" {
+		correlationId = CorrelationId(r)
+	}
+	entry := accessLogEntry{
+		Time:          t0,
+		Method:        r.Method,
+		Route:         route,
+		Uri:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		Status:        status,
+		Bytes:         w.Bytes(),
+		Duration:      float64(d.Microseconds()) / 1000,
+		RemoteAddr:    ResolveClientIP(r),
+		User:          requestUser(r),
+		CorrelationId: correlationId,
+		Referer:       r.Referer(),
+		UserAgent:     r.UserAgent(),
+	}
+	var line []byte
+	if *o.config.Format == AccessLogJson {
+		line = append(util.Marshal(entry), '\n')
+	} else {
+		line = combinedLine(&entry)
+	}
+	if _, err := o.writer.Write(line); err != nil {
+		util.Log("warning").Printf("Could not write access log: %v", err)
+	}
+}
+
+// combinedLine Combined Log Format followed by the route, the duration in ms and the correlation id
+func combinedLine(entry *accessLogEntry) []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(combinedField(entry.RemoteAddr))
+	buffer.WriteString(" - ")
+	buffer.WriteString(combinedField(entry.User))
+	buffer.WriteString(" [" + entry.Time.Format("02/Jan/2006:15:04:05 -0700") + "] ")
+	buffer.WriteString(strconv.Quote(entry.Method + " " + entry.Uri + " " + entry.Proto))
+	buffer.WriteString(" " + strconv.Itoa(entry.Status) + " ")
+	if entry.Bytes == 0 {
+		buffer.WriteString("-")
+	} else {
+		buffer.WriteString(strconv.FormatInt(entry.Bytes, 10))
+	}
+	buffer.WriteString(" " + strconv.Quote(entry.Referer) + " " + strconv.Quote(entry.UserAgent))
+	buffer.WriteString(" " + strconv.Quote(entry.Route) + " " + strconv.FormatFloat(entry.Duration, 'f', 3, 64))
+	buffer.WriteString(" " + combinedField(entry.CorrelationId) + "\n")
+	return buffer.Bytes()
+}
+
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c == '"' {
+			return '_'
+		}
+		return c
+	}, s)
+}
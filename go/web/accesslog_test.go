@@ -0,0 +1,88 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sparrowhawktech/toolkit/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "access.log")
+	config := DefaultAccessLogConfig(fileName)
+	config.Format = util.PStr(AccessLogJson)
+	config.ExcludePaths = []string{"/health", "/static/*"}
+	ConfigureAccessLog(config)
+	t.Cleanup(resetAccessLog)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", InterceptFatal(InterceptBasicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value("password") != "secret" {
+			ThrowHttpError(http.StatusUnauthorized, "Invalid credentials")
+		}
+		util.Write(w, []byte("item "+r.PathValue("id")))
+	})))
+	mux.HandleFunc("/health", InterceptFatal(func(w http.ResponseWriter, r *http.Request) {}))
+	mux.HandleFunc("/static/", InterceptFatal(func(w http.ResponseWriter, r *http.Request) {}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for path, password := range map[string]string{"/health": "secret", "/static/app.js": "secret", "/items/7?full=true": "secret", "/items/8": "wrong"} {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		request.SetBasicAuth("alice", password)
+		request.Header.Set(CorrelationIdHeaderName, "abc-123")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	// requests still running from other tests may be logged too, only the lines of this test are checked
+	var lines []string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && len(lines) < 2; time.Sleep(10 * time.Millisecond) {
+		lines = nil
+		b, _ := os.ReadFile(fileName + ".1")
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			if strings.Contains(line, `"uri":"/health"`) || strings.Contains(line, `"uri":"/static/`) || strings.Contains(line, `"uri":"/items/`) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected access log %q", lines)
+	}
+	entries := make(map[string]map[string]interface{})
+	for _, line := range lines {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries[entry["uri"].(string)] = entry
+	}
+	// rejected credentials are not recorded as the request user
+	if rejected := entries["/items/8"]; rejected == nil || rejected["status"] != float64(401) || rejected["user"] != nil {
+		t.Fatalf("Unexpected access log of rejected credentials %v", rejected)
+	}
+	entry := entries["/items/7?full=true"]
+	expected := map[string]interface{}{
+		"method":        "GET",
+		"route":         "GET /items/{id}",
+		"uri":           "/items/7?full=true",
+		"status":        float64(200),
+		"bytes":         float64(6),
+		"remoteAddr":    "127.0.0.1",
+		"user":          "alice",
+		"correlationId": "abc-123",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Fatalf("Unexpected %s %v in %v", k, entry[k], entry)
+		}
+	}
+}
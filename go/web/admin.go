@@ -0,0 +1,177 @@
+package web
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	contentTypeBinary = "application/octet-stream"
+	maxProfileSeconds = 300
+)
+
+type LogTagRequest struct {
+	Tag     *string `json:"tag"`
+	Enabled *bool   `json:"enabled"`
+}
+
+type MemoryStats struct {
+	Goroutines int              `json:"goroutines"`
+	MemStats   runtime.MemStats `json:"memStats"`
+}
+
+type ProfileInfo struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func profileSeconds(r *http.Request) time.Duration {
+	seconds := 30
+	if s := r.URL.Query().Get("seconds"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxProfileSeconds {
+			ThrowHttpError(http.StatusBadRequest, "Invalid seconds %s", s)
+		}
+		seconds = n
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sampleProfile runs start for the requested seconds or until the client goes away, the server write
+// timeout would otherwise cut long profiles
+func sampleProfile(w http.ResponseWriter, r *http.Request, name string, start func() error, stop func()) {
+	d := profileSeconds(r)
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + 10*time.Second))
+	if err != nil && err != http.ErrNotSupported {
+		util.CheckErr(err)
+	}
+	w.Header().Set(HeaderContentType, contentTypeBinary)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := start(); err != nil {
+		w.Header().Del("Content-Disposition")
+		ThrowHttpError(http.StatusConflict, "Could not start %s: %v", name, err)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	stop()
+}
+
+func cpuProfileHandler(w http.ResponseWriter, r *http.Request) {
+	sampleProfile(w, r, "profile", func() error { return pprof.StartCPUProfile(w) }, pprof.StopCPUProfile)
+}
+
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	sampleProfile(w, r, "trace", func() error { return trace.Start(w) }, trace.Stop)
+}
+
+// namedProfileHandler heap, allocs, goroutine, block, mutex and threadcreate. debug=1 renders text,
+// gc=1 runs a collection before the heap profile.
+func namedProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := PathParam(r, "name")
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		ThrowHttpError(http.StatusNotFound, "Unknown profile %s", name)
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if name == "heap" && r.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	if debug > 0 {
+		w.Header().Set(HeaderContentType, "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set(HeaderContentType, contentTypeBinary)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	}
+	util.CheckErr(profile.WriteTo(w, debug))
+}
+
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	profiles := pprof.Profiles()
+	result := make([]ProfileInfo, len(profiles))
+	for i, p := range profiles {
+		result[i] = ProfileInfo{Name: p.Name(), Count: p.Count()}
+	}
+	JsonResponse(result, w)
+}
+
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(HeaderContentType, "text/plain; charset=utf-8")
+	util.CheckErr(pprof.Lookup("goroutine").WriteTo(w, 2))
+}
+
+func memStatsHandler(w http.ResponseWriter, r *http.Request) {
+	result := MemoryStats{Goroutines: runtime.NumGoroutine()}
+	runtime.ReadMemStats(&result.MemStats)
+	JsonResponse(result, w)
+}
+
+// logTagsHandler lists the enabled util.Log tags, POST {"tag":"debug","enabled":true} toggles one
+func logTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		request := LogTagRequest{}
+		ParseParamOrBody(r, &request)
+		if request.Tag == nil || *request.Tag == "" || request.Enabled == nil {
+			ThrowHttpError(http.StatusBadRequest, "tag and enabled are required")
+		}
+		util.SetLogTag(*request.Tag, *request.Enabled)
+		util.Log("info").Printf("Log tag %s enabled: %v", *request.Tag, *request.Enabled)
+	}
+	JsonResponse(map[string]interface{}{"tags": util.LogTags()}, w)
+}
+
+func databasesHandler(w http.ResponseWriter, r *http.Request) {
+	JsonResponse(sql.GlobalDatabases.Stats(), w)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	JsonResponse(util.GetVersionInfo(), w)
+}
+
+// ConfigureAdmin serves the diagnostics under prefix, i.e. "/admin", protected by secret sent in the secret header:
+//
+//	/pprof                   profile list
+//	/pprof/profile?seconds=  cpu profile
+//	/pprof/trace?seconds=    execution trace
+//	/pprof/{name}?debug=     heap, allocs, goroutine, block, mutex, threadcreate
+//	/goroutines              goroutine dump
+//	/memstats                runtime memory stats
+//	/stats                   web stats snapshot
+//	/logs                    log tags, POST to toggle one
+//	/databases               connection pool stats
+//	/version                 build info
+func ConfigureAdmin(serveMux *http.ServeMux, prefix string, secret string) {
+	ConfigureAdminFiltered(serveMux, prefix, secret, nil)
+}
+
+// ConfigureAdminFiltered same as ConfigureAdmin, only reachable from the networks the filter allows
+func ConfigureAdminFiltered(serveMux *http.ServeMux, prefix string, secret string, filter *IPFilter) {
+	if secret == "" {
+		panic("Admin endpoints require a secret")
+	}
+	handlers := map[string]func(w http.ResponseWriter, r *http.Request){
+		"/pprof":         profilesHandler,
+		"/pprof/profile": cpuProfileHandler,
+		"/pprof/trace":   traceHandler,
+		"/pprof/{name}":  namedProfileHandler,
+		"/goroutines":    goroutinesHandler,
+		"/memstats":      memStatsHandler,
+		"/stats":         StatsHandler,
+		"/logs":          logTagsHandler,
+		"/databases":     databasesHandler,
+		"/version":       versionHandler,
+	}
+	for path, f := range handlers {
+		serveMux.HandleFunc(prefix+path, InterceptFatal(InterceptIPFilter(filter, InterceptSecretHeader(secret, InterceptCORS(f)))))
+	}
+}
@@ -0,0 +1,82 @@
+package web_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	util.ConfigLoggers(filepath.Join(t.TempDir(), "admin.log"), 1024*1024, 2, true, log.LstdFlags, "info", "warning", "error")
+	t.Cleanup(util.ResetLoggers)
+	mux := http.NewServeMux()
+	web.ConfigureAdmin(mux, "/admin", "s3cret")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	call := func(method string, path string, body string) (int, []byte) {
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		request.Header.Set("secret", "s3cret")
+		request.Header.Set(web.HeaderContentType, web.ContentTypeApplicationJson)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		return response.StatusCode, b
+	}
+
+	// the secret is only taken from the header, query parameters end up in access logs
+	for path, secret := range map[string]string{"/admin/version": "", "/admin/version?secret=s3cret": "", "/admin/stats": "wrong"} {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if secret != "" {
+			request.Header.Set("secret", secret)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Unexpected status %d for %s with secret %q", response.StatusCode, path, secret)
+		}
+	}
+	if status, body := call(http.MethodGet, "/admin/memstats", ""); status != http.StatusOK || !bytes.Contains(body, []byte(`"goroutines"`)) {
+		t.Fatalf("Unexpected memstats %d %s", status, body)
+	}
+	if status, body := call(http.MethodGet, "/admin/goroutines", ""); status != http.StatusOK || !bytes.Contains(body, []byte("goroutine ")) {
+		t.Fatalf("Unexpected goroutine dump %d %s", status, body)
+	}
+	if status, body := call(http.MethodGet, "/admin/pprof/heap?debug=1", ""); status != http.StatusOK || !bytes.Contains(body, []byte("heap profile")) {
+		t.Fatalf("Unexpected heap profile %d %s", status, body)
+	}
+	if status, _ := call(http.MethodGet, "/admin/pprof/nothing", ""); status != http.StatusNotFound {
+		t.Fatalf("Unexpected status %d for an unknown profile", status)
+	}
+
+	tags := func(body []byte) string {
+		result := map[string][]string{}
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(result["tags"], ",")
+	}
+	if status, body := call(http.MethodGet, "/admin/logs", ""); status != http.StatusOK || tags(body) != "error,info,warning" {
+		t.Fatalf("Unexpected tags %d %s", status, body)
+	}
+	if _, body := call(http.MethodPost, "/admin/logs", `{"tag":"debug","enabled":true}`); tags(body) != "debug,error,info,warning" || !util.Loggable("debug") {
+		t.Fatalf("Tag not enabled %s", body)
+	}
+	if _, body := call(http.MethodPost, "/admin/logs", `{"tag":"debug","enabled":false}`); tags(body) != "error,info,warning" || util.Loggable("debug") {
+		t.Fatalf("Tag not disabled %s", body)
+	}
+}
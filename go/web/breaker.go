@@ -0,0 +1,292 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (o BreakerState) String() string {
+	switch o {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+func (o BreakerState) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + o.String() + `"`), nil
+}
+
+// BreakerConfig the breaker opens when, within Window seconds and after at least MinRequests, the
+// failure rate reaches FailureRate. After CoolDown seconds up to HalfOpenRequests probes are let
+// through, the first failure opens it again and HalfOpenRequests successes close it.
+type BreakerConfig struct {
+	FailureRate      *float64 `json:"failureRate"`
+	MinRequests      *int     `json:"minRequests"`
+	Window           *int     `json:"window"`
+	CoolDown         *int     `json:"coolDown"`
+	HalfOpenRequests *int     `json:"halfOpenRequests"`
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureRate:      util.PFloat64(0.5),
+		MinRequests:      util.PInt(10),
+		Window:           util.PInt(60),
+		CoolDown:         util.PInt(30),
+		HalfOpenRequests: util.PInt(1),
+	}
+}
+
+func (o *BreakerConfig) Validate() {
+	if o.FailureRate == nil || *o.FailureRate <= 0 || *o.FailureRate > 1 {
+		panic("Invalid failureRate")
+	}
+	if o.MinRequests == nil || *o.MinRequests < 1 {
+		panic("Invalid minRequests")
+	}
+	if o.Window == nil || *o.Window < 1 {
+		panic("Invalid window")
+	}
+	if o.CoolDown == nil || *o.CoolDown < 1 {
+		panic("Invalid coolDown")
+	}
+	if o.HalfOpenRequests == nil || *o.HalfOpenRequests < 1 {
+		panic("Invalid halfOpenRequests")
+	}
+}
+
+type CircuitOpenError struct {
+	Name string
+}
+
+func (o CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker %s is open", o.Name)
+}
+
+type BreakerSnapshot struct {
+	Name          string       `json:"name"`
+	State         BreakerState `json:"state"`
+	Requests      int64        `json:"requests"`
+	Failures      int64        `json:"failures"`
+	TotalRequests int64        `json:"totalRequests"`
+	TotalFailures int64        `json:"totalFailures"`
+	TotalRejected int64        `json:"totalRejected"`
+	Trips         int64        `json:"trips"`
+	OpenedAt      *time.Time   `json:"openedAt"`
+}
+
+type CircuitBreaker struct {
+	name             string
+	config           BreakerConfig
+	mux              *sync.Mutex
+	state            BreakerState
+	generation       uint64
+	windowStart      time.Time
+	requests         int64
+	failures         int64
+	openedAt         time.Time
+	halfOpenInFlight int
+	halfOpenSuccess  int
+	totalRequests    int64
+	totalFailures    int64
+	totalRejected    int64
+	trips            int64
+}
+
+// Allow reserves a slot for a call, every true must be followed by Success, Failure or Cancel with the
+// returned generation. Results of calls let through before the last state change are ignored.
+func (o *CircuitBreaker) Allow() (uint64, bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	now := time.Now()
+	if o.state == BreakerOpen && now.Sub(o.openedAt) >= time.Duration(*o.config.CoolDown)*time.Second {
+		o.transition(BreakerHalfOpen, now)
+	}
+	switch o.state {
+	case BreakerOpen:
+		o.totalRejected++
+		return o.generation, false
+	case BreakerHalfOpen:
+		if o.halfOpenInFlight+o.halfOpenSuccess >= *o.config.HalfOpenRequests {
+			o.totalRejected++
+			return o.generation, false
+		}
+		o.halfOpenInFlight++
+	default:
+		if now.Sub(o.windowStart) > time.Duration(*o.config.Window)*time.Second {
+			o.windowStart = now
+			o.requests = 0
+			o.failures = 0
+		}
+	}
+	return o.generation, true
+}
+
+func (o *CircuitBreaker) Success(generation uint64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.totalRequests++
+	if generation != o.generation {
+		return
+	}
+	if o.state == BreakerHalfOpen {
+		o.halfOpenInFlight--
+		o.halfOpenSuccess++
+		if o.halfOpenSuccess >= *o.config.HalfOpenRequests {
+			o.transition(BreakerClosed, time.Now())
+		}
+		return
+	}
+	o.requests++
+}
+
+func (o *CircuitBreaker) Failure(generation uint64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.totalRequests++
+	o.totalFailures++
+	if generation != o.generation {
+		return
+	}
+	now := time.Now()
+	if o.state == BreakerHalfOpen {
+		o.halfOpenInFlight--
+		o.transition(BreakerOpen, now)
+		return
+	}
+	if o.state == BreakerOpen {
+		return
+	}
+	o.requests++
+	o.failures++
+	if o.requests >= int64(*o.config.MinRequests) && float64(o.failures)/float64(o.requests) >= *o.config.FailureRate {
+		o.transition(BreakerOpen, now)
+	}
+}
+
+// Cancel releases the slot of a call that neither succeeded nor failed (i.e. canceled by the caller)
+func (o *CircuitBreaker) Cancel(generation uint64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if generation == o.generation && o.state == BreakerHalfOpen {
+		o.halfOpenInFlight--
+	}
+}
+
+func (o *CircuitBreaker) transition(state BreakerState, now time.Time) {
+	util.Log("warning").Printf("Circuit breaker %s: %v -> %v", o.name, o.state, state)
+	o.state = state
+	o.generation++
+	o.halfOpenInFlight = 0
+	o.halfOpenSuccess = 0
+	o.requests = 0
+	o.failures = 0
+	o.windowStart = now
+	if state == BreakerOpen {
+		o.openedAt = now
+		o.trips++
+	}
+}
+
+func (o *CircuitBreaker) State() BreakerState {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.state
+}
+
+func (o *CircuitBreaker) Snapshot() BreakerSnapshot {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	result := BreakerSnapshot{
+		Name:          o.name,
+		State:         o.state,
+		Requests:      o.requests,
+		Failures:      o.failures,
+		TotalRequests: o.totalRequests,
+		TotalFailures: o.totalFailures,
+		TotalRejected: o.totalRejected,
+		Trips:         o.trips,
+	}
+	if o.state != BreakerClosed {
+		result.OpenedAt = util.PTime(o.openedAt)
+	}
+	return result
+}
+
+func NewCircuitBreaker(name string, config BreakerConfig) *CircuitBreaker {
+	config.Validate()
+	return &CircuitBreaker{name: name, config: config, mux: &sync.Mutex{}, windowStart: time.Now()}
+}
+
+type breakerRegistry struct {
+	mux      *sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func (o *breakerRegistry) resolve(name string, config BreakerConfig) *CircuitBreaker {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	b, ok := o.breakers[name]
+	if !ok {
+		b = NewCircuitBreaker(name, config)
+		o.breakers[name] = b
+	}
+	return b
+}
+
+func (o *breakerRegistry) snapshot() []BreakerSnapshot {
+	o.mux.Lock()
+	list := make([]*CircuitBreaker, 0, len(o.breakers))
+	for _, b := range o.breakers {
+		list = append(list, b)
+	}
+	o.mux.Unlock()
+	result := make([]BreakerSnapshot, len(list))
+	for i, b := range list {
+		result[i] = b.Snapshot()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+var breakers = &breakerRegistry{mux: &sync.Mutex{}, breakers: make(map[string]*CircuitBreaker)}
+
+// ResolveBreaker breakers are shared by name, the config only applies when the breaker is created
+func ResolveBreaker(name string, config BreakerConfig) *CircuitBreaker {
+	return breakers.resolve(name, config)
+}
+
+func BreakerStats() []BreakerSnapshot {
+	return breakers.snapshot()
+}
+
+func BreakerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	JsonResponse(BreakerStats(), w)
+}
+
+// ConfigureDefaultBreaker enables a breaker per host for the package level helpers (GetJson, PostJson...)
+func ConfigureDefaultBreaker(config BreakerConfig) {
+	config.Validate()
+	defaultClient.Breaker = &config
+}
@@ -0,0 +1,42 @@
+package web_test
+
+import (
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+	"time"
+)
+
+func TestBreakerGenerations(t *testing.T) {
+	config := web.DefaultBreakerConfig()
+	config.MinRequests = util.PInt(1)
+	config.CoolDown = util.PInt(1)
+	breaker := web.NewCircuitBreaker("generations", config)
+
+	stale, _ := breaker.Allow()
+	failing, _ := breaker.Allow()
+	breaker.Failure(failing)
+	if breaker.State() != web.BreakerOpen {
+		t.Fatalf("Unexpected state %v", breaker.State())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	probe, ok := breaker.Allow()
+	if !ok || breaker.State() != web.BreakerHalfOpen {
+		t.Fatalf("Probe not allowed, state %v", breaker.State())
+	}
+
+	// calls let through while closed finishing now must neither close nor reopen the breaker
+	breaker.Success(stale)
+	breaker.Failure(stale)
+	breaker.Cancel(stale)
+	if breaker.State() != web.BreakerHalfOpen {
+		t.Fatalf("Stale result changed the state to %v", breaker.State())
+	}
+	if _, ok := breaker.Allow(); ok {
+		t.Fatal("Second probe allowed while the first one is in flight")
+	}
+	breaker.Success(probe)
+	if breaker.State() != web.BreakerClosed {
+		t.Fatalf("Probe success did not close the breaker, state %v", breaker.State())
+	}
+}
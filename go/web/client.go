@@ -0,0 +1,318 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+// ClientAuth decorates every outgoing request (and every retry of it)
+type ClientAuth interface {
+	Apply(request *http.Request)
+}
+
+type BearerAuth struct {
+	Token string
+}
+
+func (o BearerAuth) Apply(request *http.Request) {
+	request.Header.Set(HeaderAuthorization, "Bearer "+o.Token)
+}
+
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (o BasicAuth) Apply(request *http.Request) {
+	request.SetBasicAuth(o.Username, o.Password)
+}
+
+// SignedAuth version 2 signatures as expected by InterceptSigned, the body must be replayable
+type SignedAuth struct {
+	ClientId string
+	Secret   string
+}
+
+func (o SignedAuth) Apply(request *http.Request) {
+	SignRequest(request, o.ClientId, o.Secret)
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+	}
+}
+
+// backoff exponential with jitter, attempt starting at 1
+func (o *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(o.InitialBackoff) * math.Pow(o.Multiplier, float64(attempt-1))
+	if d > float64(o.MaxBackoff) {
+		d = float64(o.MaxBackoff)
+	}
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// sharedTransport keeps connections alive across calls and clients
+var sharedTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	TLSClientConfig:     &tls.Config{},
+	ForceAttemptHTTP2:   true,
+	MaxIdleConns:        256,
+	MaxIdleConnsPerHost: 32,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// Client outbound http client. Paths are resolved against BaseUrl unless they are absolute urls.
+// Retries only apply to idempotent methods, or requests carrying an idempotency key.
+// A circuit breaker is applied when Breaker is set, shared by BreakerName or by host when empty.
+type Client struct {
+	BaseUrl     string
+	Headers     map[string]string
+	Auth        ClientAuth
+	Retry       *RetryPolicy
+	Breaker     *BreakerConfig
+	BreakerName string
+	httpClient  *http.Client
+}
+
+func (o *Client) clone() *Client {
+	c := *o
+	return &c
+}
+
+// WithTimeout a copy of the client with a different timeout, the transport is still shared
+func (o *Client) WithTimeout(timeout time.Duration) *Client {
+	c := o.clone()
+	c.httpClient = &http.Client{Transport: o.httpClient.Transport, Timeout: timeout}
+	return c
+}
+
+func (o *Client) WithAuth(auth ClientAuth) *Client {
+	c := o.clone()
+	c.Auth = auth
+	return c
+}
+
+func (o *Client) resolveUrl(path string) string {
+	if o.BaseUrl == "" || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	if path == "" {
+		return o.BaseUrl
+	}
+	return strings.TrimRight(o.BaseUrl, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+func (o *Client) newRequest(ctx context.Context, method string, path string, body io.Reader, headers map[string]string) *http.Request {
+	request, err := http.NewRequestWithContext(ctx, method, o.resolveUrl(path), body)
+	util.CheckErr(err)
+	for k, v := range o.Headers {
+		request.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	setCorrelationHeader(ctx, request)
+	return request
+}
+
+func (o *Client) canRetry(request *http.Request) bool {
+	if o.Retry == nil || o.Retry.MaxAttempts <= 1 {
+		return false
+	}
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+	return idempotentMethods[request.Method] || request.Header.Get(HeaderIdempotencyKey) != ""
+}
+
+// Do sends the request, the caller owns the response. Bodies given as *bytes.Buffer, *bytes.Reader
+// or *strings.Reader can be replayed on retries.
+func (o *Client) Do(ctx context.Context, method string, path string, body io.Reader, headers map[string]string) *http.Response {
+	request := o.newRequest(ctx, method, path, body, headers)
+	retry := o.canRetry(request)
+	attempt := 1
+	for {
+		if o.Auth != nil {
+			o.Auth.Apply(request)
+		}
+		breaker := o.resolveBreaker(request)
+		var generation uint64
+		if breaker != nil {
+			var allowed bool
+			if generation, allowed = breaker.Allow(); !allowed {
+				panic(CircuitOpenError{Name: breaker.name})
+			}
+		}
+		response, err := o.httpClient.Do(request)
+		recordBreaker(ctx, breaker, generation, response, err)
+		if !retry || attempt >= o.Retry.MaxAttempts || ctx.Err() != nil || (err == nil && !isRetryableStatus(response.StatusCode)) {
+			util.CheckErr(err)
+			return response
+		}
+		wait := o.Retry.backoff(attempt)
+		if err != nil {
+			util.LogContext(ctx, "warning").Printf("%s %s failed, retrying in %v: %v", method, request.URL.Redacted(), wait, err)
+		} else {
+			if retryAfter, e := strconv.Atoi(response.Header.Get(HeaderRetryAfter)); e == nil && time.Duration(retryAfter)*time.Second > wait {
+				wait = min(time.Duration(retryAfter)*time.Second, o.Retry.MaxBackoff)
+			}
+			util.LogContext(ctx, "warning").Printf("%s %s returned %d, retrying in %v", method, request.URL.Redacted(), response.StatusCode, wait)
+			drainResponse(response)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			panic(ctx.Err())
+		}
+		attempt++
+		request = o.rebuildRequest(ctx, request)
+	}
+}
+
+func (o *Client) resolveBreaker(request *http.Request) *CircuitBreaker {
+	if o.Breaker == nil {
+		return nil
+	}
+	name := o.BreakerName
+	if name == "" {
+		name = request.URL.Host
+	}
+	return ResolveBreaker(name, *o.Breaker)
+}
+
+// recordBreaker transport errors and 5xx count as failures, calls canceled by the caller do not count
+func recordBreaker(ctx context.Context, breaker *CircuitBreaker, generation uint64, response *http.Response, err error) {
+	if breaker == nil {
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		breaker.Cancel(generation)
+	} else if err != nil || response.StatusCode >= http.StatusInternalServerError {
+		breaker.Failure(generation)
+	} else {
+		breaker.Success(generation)
+	}
+}
+
+func (o *Client) rebuildRequest(ctx context.Context, request *http.Request) *http.Request {
+	next := request.Clone(ctx)
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		util.CheckErr(err)
+		next.Body = body
+	}
+	return next
+}
+
+// drainResponse lets the connection go back to the pool
+func drainResponse(response *http.Response) {
+	_, err := io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if err != nil && !errors.Is(err, context.Canceled) {
+		util.ProcessError(err)
+	}
+	CloseResponse(response)
+}
+
+func (o *Client) Request(ctx context.Context, method string, path string, out io.Reader, in io.Writer, maxResult int, headers map[string]string) {
+	response := o.Do(ctx, method, path, out, headers)
+	defer CloseResponse(response)
+	CheckResponse(response, maxResult)
+	if in != nil {
+		_, err := io.Copy(in, response.Body)
+		util.CheckErr(err)
+	}
+}
+
+func (o *Client) JsonRequest(ctx context.Context, method string, path string, out interface{}, in interface{}, maxResult int, headers map[string]string) {
+	buffer := &bytes.Buffer{}
+	if out != nil {
+		util.JsonEncode(out, buffer)
+	}
+	allHeaders := map[string]string{HeaderContentType: ContentTypeApplicationJson}
+	for k, v := range headers {
+		allHeaders[k] = v
+	}
+	response := o.Do(ctx, method, path, buffer, allHeaders)
+	defer CloseResponse(response)
+	CheckResponse(response, maxResult)
+	if in != nil {
+		util.JsonDecode(in, response.Body)
+	}
+}
+
+func (o *Client) GetJson(ctx context.Context, path string, maxResult int, headers map[string]string, entity interface{}) {
+	o.JsonRequest(ctx, http.MethodGet, path, nil, entity, maxResult, headers)
+}
+
+func (o *Client) Get(ctx context.Context, path string, maxResult int, headers map[string]string) []byte {
+	result := &bytes.Buffer{}
+	o.Request(ctx, http.MethodGet, path, nil, result, maxResult, headers)
+	return result.Bytes()
+}
+
+func (o *Client) GetStream(ctx context.Context, path string, maxResult int, headers map[string]string, w io.Writer) {
+	o.Request(ctx, http.MethodGet, path, nil, w, maxResult, headers)
+}
+
+func (o *Client) PostJson(ctx context.Context, path string, out interface{}, in interface{}, maxResult int, headers map[string]string) {
+	o.JsonRequest(ctx, http.MethodPost, path, out, in, maxResult, headers)
+}
+
+func (o *Client) PutJson(ctx context.Context, path string, out interface{}, in interface{}, maxResult int, headers map[string]string) {
+	o.JsonRequest(ctx, http.MethodPut, path, out, in, maxResult, headers)
+}
+
+func (o *Client) DeleteJson(ctx context.Context, path string, out interface{}, in interface{}, maxResult int, headers map[string]string) {
+	o.JsonRequest(ctx, http.MethodDelete, path, out, in, maxResult, headers)
+}
+
+func NewClient(baseUrl string) *Client {
+	return NewClientWithTransport(baseUrl, sharedTransport)
+}
+
+func NewClientWithTransport(baseUrl string, transport http.RoundTripper) *Client {
+	return &Client{
+		BaseUrl:    baseUrl,
+		Headers:    make(map[string]string),
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+var defaultClient = NewClient("")
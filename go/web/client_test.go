@@ -0,0 +1,94 @@
+package web_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var breakerNames atomic.Int64
+
+// uniqueBreakerName breakers are registered process wide, repeated runs must not find the previous state
+func uniqueBreakerName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), breakerNames.Add(1))
+}
+
+func TestClientRetry(t *testing.T) {
+	calls := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get(web.HeaderAuthorization) != "Bearer token" || r.Header.Get("X-Default") != "yes" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		web.JsonResponse(map[string]string{"path": r.URL.Path}, w)
+	}))
+	defer server.Close()
+
+	client := web.NewClient(server.URL + "/api/")
+	client.Headers["X-Default"] = "yes"
+	client.Auth = web.BearerAuth{Token: "token"}
+	client.Retry = &web.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Multiplier: 2}
+
+	result := map[string]string{}
+	client.GetJson(context.Background(), "/items", 200, nil, &result)
+	if result["path"] != "/api/items" || calls.Load() != 3 {
+		t.Fatalf("Unexpected result %v after %d calls", result, calls.Load())
+	}
+
+	calls.Store(0)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("POST should not be retried")
+			}
+		}()
+		client.PostJson(context.Background(), "/items", map[string]string{}, nil, 200, nil)
+	}()
+	if calls.Load() != 1 {
+		t.Fatalf("POST sent %d times", calls.Load())
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	calls := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	config := web.DefaultBreakerConfig()
+	config.MinRequests = util.PInt(2)
+	client := web.NewClient(server.URL)
+	client.Breaker = &config
+	client.BreakerName = uniqueBreakerName(t)
+
+	get := func() (result interface{}) {
+		defer func() {
+			result = recover()
+		}()
+		client.Get(context.Background(), "/", 200, nil)
+		return nil
+	}
+	get()
+	get()
+	if _, ok := get().(web.CircuitOpenError); !ok {
+		t.Fatal("Breaker did not open")
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("Open breaker let %d calls through", calls.Load())
+	}
+	if web.ResolveBreaker(client.BreakerName, config).State() != web.BreakerOpen {
+		t.Fatal("Breaker state not exposed")
+	}
+}
@@ -0,0 +1,295 @@
+package web
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	HeaderAcceptEncoding  = "Accept-Encoding"
+	HeaderContentEncoding = "Content-Encoding"
+	HeaderContentLength   = "Content-Length"
+	HeaderVary            = "Vary"
+)
+
+type CompressionConfig struct {
+	MinSize      *int     `json:"minSize"`
+	Level        *int     `json:"level"`
+	ContentTypes []string `json:"contentTypes"`
+}
+
+func DefaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		MinSize: util.PInt(1024),
+		Level:   util.PInt(gzip.DefaultCompression),
+		ContentTypes: []string{
+			ContentTypeApplicationJson,
+			"application/javascript",
+			"application/xml",
+			"image/svg+xml",
+			"text/*",
+		},
+	}
+}
+
+func (o *CompressionConfig) Validate() {
+	if o.MinSize == nil || *o.MinSize < 0 {
+		panic("Invalid minSize")
+	}
+	if o.Level == nil || *o.Level < gzip.HuffmanOnly || *o.Level > gzip.BestCompression {
+		panic("Invalid level")
+	}
+}
+
+func (o *CompressionConfig) allows(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == ContentTypeEventStream {
+		return false
+	}
+	for _, allowed := range o.ContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+var compression *CompressionConfig
+
+// ConfigureCompression enables response compression for every handler going through InterceptFatal
+func ConfigureCompression(config CompressionConfig) {
+	config.Validate()
+	compression = &config
+}
+
+// negotiateEncoding picks gzip or deflate from Accept-Encoding honoring q-values, empty when none is acceptable.
+// "*" only applies to the codings not listed, so "gzip;q=0, *" refuses gzip.
+func negotiateEncoding(acceptEncoding string) string {
+	listed := make(map[string]float64)
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else if coding != "" {
+			listed[coding] = q
+		}
+	}
+	best := ""
+	bestQ := 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := listed[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers up to MinSize bytes before deciding whether the response gets compressed.
+// Status and headers are held until the decision is made.
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressionConfig
+	encoding string
+	status   int
+	buffer   []byte
+	encoder  io.WriteCloser
+	decided  bool
+}
+
+func (o *compressWriter) WriteHeader(status int) {
+	if o.decided {
+		o.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if o.status != 0 {
+		return
+	}
+	o.status = status
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		o.passThrough()
+	}
+}
+
+func (o *compressWriter) Write(b []byte) (int, error) {
+	if !o.decided {
+		o.buffer = append(o.buffer, b...)
+		if len(o.buffer) < *o.config.MinSize {
+			return len(b), nil
+		}
+		o.decide()
+		return len(b), o.flushBuffer()
+	}
+	if o.encoder != nil {
+		return o.encoder.Write(b)
+	}
+	return o.ResponseWriter.Write(b)
+}
+
+func (o *compressWriter) decide() {
+	header := o.Header()
+	if header.Get(HeaderContentType) == "" {
+		header.Set(HeaderContentType, http.DetectContentType(o.buffer))
+	}
+	if header.Get(HeaderContentEncoding) != "" || !o.config.allows(header.Get(HeaderContentType)) {
+		o.passThrough()
+		return
+	}
+	var err error
+	if o.encoding == "gzip" {
+		o.encoder, err = gzip.NewWriterLevel(o.ResponseWriter, *o.config.Level)
+	} else {
+		// http deflate is the zlib format, not raw deflate
+		o.encoder, err = zlib.NewWriterLevel(o.ResponseWriter, *o.config.Level)
+	}
+	util.CheckErr(err)
+	header.Set(HeaderContentEncoding, o.encoding)
+	header.Del(HeaderContentLength)
+	// the encoded bytes differ from the ones hashed, the tag is only semantically equivalent
+	if etag := header.Get(HeaderETag); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set(HeaderETag, "W/"+etag)
+	}
+	o.decided = true
+	o.writeStatus()
+}
+
+func (o *compressWriter) passThrough() {
+	o.decided = true
+	o.writeStatus()
+}
+
+func (o *compressWriter) writeStatus() {
+	if o.status != 0 {
+		o.ResponseWriter.WriteHeader(o.status)
+	}
+}
+
+func (o *compressWriter) flushBuffer() error {
+	if len(o.buffer) == 0 {
+		return nil
+	}
+	buffer := o.buffer
+	o.buffer = nil
+	var err error
+	if o.encoder != nil {
+		_, err = o.encoder.Write(buffer)
+	} else {
+		_, err = o.ResponseWriter.Write(buffer)
+	}
+	return err
+}
+
+// Flush streaming responses cannot wait for MinSize, the decision is taken on the first flush
+func (o *compressWriter) Flush() {
+	_ = o.FlushError()
+}
+
+func (o *compressWriter) FlushError() error {
+	if !o.decided {
+		o.decide()
+		if err := o.flushBuffer(); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := o.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(o.ResponseWriter).Flush()
+}
+
+func (o *compressWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+func (o *compressWriter) held() bool {
+	return !o.decided
+}
+
+func (o *compressWriter) discard() {
+	if !o.decided {
+		o.status = 0
+		o.buffer = nil
+	}
+}
+
+// Close small responses are written as they are, compressed ones get their trailer written
+func (o *compressWriter) Close() error {
+	if !o.decided {
+		if o.status == 0 && len(o.buffer) == 0 {
+			return nil
+		}
+		o.passThrough()
+	}
+	err := o.flushBuffer()
+	if err != nil {
+		return err
+	}
+	if o.encoder != nil {
+		return o.encoder.Close()
+	}
+	return nil
+}
+
+func InterceptCompression(config CompressionConfig, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	config.Validate()
+	return func(w http.ResponseWriter, r *http.Request) {
+		doCompress(&config, w, r, delegate)
+	}
+}
+
+func doCompress(config *CompressionConfig, w http.ResponseWriter, r *http.Request, delegate func(w http.ResponseWriter, r *http.Request)) {
+	if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+		delegate(w, r)
+		return
+	}
+	w.Header().Add(HeaderVary, HeaderAcceptEncoding)
+	encoding := negotiateEncoding(r.Header.Get(HeaderAcceptEncoding))
+	if encoding == "" {
+		delegate(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, config: config, encoding: encoding}
+	// not deferred, what a panicking handler left in the buffer must not be sent
+	delegate(cw, r)
+	if err := cw.Close(); err != nil {
+		util.ProcessErrorContext(r.Context(), err)
+	}
+}
+
+func interceptCompressionIfConfigured(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if compression == nil {
+			delegate(w, r)
+		} else {
+			doCompress(compression, w, r, delegate)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package web_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"name":"value"},`, 200)
+	handler := web.InterceptCompression(web.DefaultCompressionConfig(), func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set(web.HeaderContentType, web.ContentTypeApplicationJson)
+			util.Write(w, []byte(`{"small":true}`))
+		case "/image":
+			w.Header().Set(web.HeaderContentType, "image/png")
+			util.Write(w, []byte(large))
+		case "/encoded":
+			w.Header().Set(web.HeaderContentType, web.ContentTypeApplicationJson)
+			w.Header().Set(web.HeaderContentEncoding, "br")
+			util.Write(w, []byte(large))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set(web.HeaderContentType, web.ContentTypeApplicationJson)
+			util.Write(w, []byte(large))
+		}
+	})
+	cases := []struct {
+		method         string
+		path           string
+		acceptEncoding string
+		headers        map[string]string
+		encoding       string
+	}{
+		{http.MethodGet, "/json", "gzip, deflate", nil, "gzip"},
+		{http.MethodGet, "/json", "deflate", nil, "deflate"},
+		{http.MethodGet, "/json", "gzip;q=0.5, deflate;q=0.8", nil, "deflate"},
+		{http.MethodGet, "/json", "*", nil, "gzip"},
+		{http.MethodGet, "/json", "gzip;q=0", nil, ""},
+		{http.MethodGet, "/json", "gzip;q=0, *", nil, "deflate"},
+		{http.MethodGet, "/json", "gzip;q=0, deflate;q=0, *", nil, ""},
+		{http.MethodGet, "/json", "deflate;q=0.5, *;q=0.8", nil, "gzip"},
+		{http.MethodGet, "/json", "*;q=0", nil, ""},
+		{http.MethodGet, "/json", "br", nil, ""},
+		{http.MethodGet, "/json", "", nil, ""},
+		{http.MethodGet, "/small", "gzip", nil, ""},
+		{http.MethodGet, "/image", "gzip", nil, ""},
+		{http.MethodGet, "/encoded", "gzip", nil, "br"},
+		{http.MethodGet, "/empty", "gzip", nil, ""},
+		{http.MethodGet, "/json", "gzip", map[string]string{"Range": "bytes=0-10"}, ""},
+		{http.MethodHead, "/json", "gzip", nil, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.acceptEncoding != "" {
+			r.Header.Set(web.HeaderAcceptEncoding, c.acceptEncoding)
+		}
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		encoding := recorder.Header().Get(web.HeaderContentEncoding)
+		if encoding != c.encoding {
+			t.Fatalf("%s %s %q: unexpected encoding %q, expected %q", c.method, c.path, c.acceptEncoding, encoding, c.encoding)
+		}
+		var reader io.Reader
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(recorder.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader = gz
+		case "deflate":
+			zr, err := zlib.NewReader(recorder.Body)
+			if err != nil {
+				t.Fatalf("deflate body is not zlib: %v", err)
+			}
+			reader = zr
+		default:
+			continue
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(body, []byte(large)) {
+			t.Fatalf("%s %s: unexpected body %v", c.method, c.path, err)
+		}
+		if recorder.Header().Get(web.HeaderVary) != web.HeaderAcceptEncoding || recorder.Header().Get(web.HeaderContentLength) != "" {
+			t.Fatalf("Unexpected headers %v", recorder.Header())
+		}
+	}
+}
+
+func TestCompressionPanic(t *testing.T) {
+	large := strings.Repeat(`{"name":"value"},`, 200)
+	handler := web.InterceptCompression(web.DefaultCompressionConfig(), web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(web.HeaderContentType, web.ContentTypeApplicationJson)
+		w.WriteHeader(http.StatusCreated)
+		if r.URL.Path == "/large" {
+			util.Write(w, []byte(large))
+		} else {
+			util.Write(w, []byte(`{"partial":`))
+		}
+		panic("failed")
+	}))
+
+	// the status and body held by the compression buffer never reached the client, they are replaced by the error
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/small", nil)
+	r.Header.Set(web.HeaderAcceptEncoding, "gzip")
+	handler(recorder, r)
+	if recorder.Code != http.StatusInternalServerError || recorder.Header().Get(web.HeaderContentEncoding) != "" ||
+		strings.Contains(recorder.Body.String(), "partial") || !strings.Contains(recorder.Body.String(), "failed") {
+		t.Fatalf("Unexpected response %d %v %q", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+
+	// once sent the response is aborted
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/large", nil)
+	request.Header.Set(web.HeaderAcceptEncoding, "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err == nil {
+		_, err = io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("Committed response not aborted")
+	}
+}
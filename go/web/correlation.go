@@ -0,0 +1,60 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const maxCorrelationIdLength = 128
+
+func NewCorrelationId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	util.CheckErr(err)
+	return hex.EncodeToString(b)
+}
+
+// validCorrelationId incoming ids end up in log lines and postgres settings, only a safe charset is accepted
+func validCorrelationId(id string) bool {
+	if len(id) == 0 || len(id) > maxCorrelationIdLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+func CorrelationId(r *http.Request) string {
+	return util.CorrelationId(r.Context())
+}
+
+// InterceptCorrelation accepts the incoming correlation id header or generates a new one, stores it
+// in the request context and echoes it in the response
+func InterceptCorrelation(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if util.CorrelationId(r.Context()) != "" {
+			delegate(w, r)
+			return
+		}
+		correlationId := r.Header.Get(CorrelationIdHeaderName)
+		if !validCorrelationId(correlationId) {
+			correlationId = NewCorrelationId()
+		}
+		w.Header().Set(CorrelationIdHeaderName, correlationId)
+		delegate(w, r.WithContext(util.WithCorrelationId(r.Context(), correlationId)))
+	}
+}
+
+func setCorrelationHeader(ctx context.Context, request *http.Request) {
+	correlationId := util.CorrelationId(ctx)
+	if correlationId != "" && request.Header.Get(CorrelationIdHeaderName) == "" {
+		request.Header.Set(CorrelationIdHeaderName, correlationId)
+	}
+}
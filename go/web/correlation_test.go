@@ -0,0 +1,80 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+func TestCorrelation(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "correlation.log")
+	util.ConfigLoggers(fileName, 1024*1024, 2, false, 0, "info")
+	t.Cleanup(util.ResetLoggers)
+
+	var downstream string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/downstream", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		downstream = web.CorrelationId(r)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/upstream", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		util.LogContext(r.Context(), "info").Print("calling downstream")
+		web.NewClient(server.URL).Get(r.Context(), "/downstream", 1024, nil)
+	}))
+
+	call := func(correlationId string) string {
+		downstream = ""
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/upstream", nil)
+		if correlationId != "" {
+			request.Header.Set(web.CorrelationIdHeaderName, correlationId)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", response.StatusCode)
+		}
+		echoed := response.Header.Get(web.CorrelationIdHeaderName)
+		if echoed != downstream {
+			t.Fatalf("Correlation id %q echoed but %q propagated downstream", echoed, downstream)
+		}
+		return echoed
+	}
+
+	if id := call("abc-123"); id != "abc-123" {
+		t.Fatalf("Incoming correlation id replaced by %q", id)
+	}
+	generated := regexp.MustCompile("^[0-9a-f]{32}$")
+	for _, incoming := range []string{"", "bad id", strings.Repeat("a", 129)} {
+		if id := call(incoming); !generated.MatchString(id) {
+			t.Fatalf("Unexpected correlation id %q generated for %q", id, incoming)
+		}
+	}
+	if first, second := call(""), call(""); first == second {
+		t.Fatalf("Same correlation id %s generated twice", first)
+	}
+
+	util.LogContext(context.Background(), "info").Print("without correlation")
+	util.LogContext(util.WithCorrelationId(context.Background(), "xyz"), "info").Print("with correlation")
+	util.FlushLoggers()
+	b, err := os.ReadFile(fileName + ".1")
+	util.CheckErr(err)
+	for _, expected := range []string{"info: [abc-123] calling downstream\n", "info: without correlation\n", "info: [xyz] with correlation\n"} {
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("%q not logged in %s", expected, b)
+		}
+	}
+	if util.CorrelationId(context.Background()) != "" || util.CorrelationId(nil) != "" {
+		t.Fatal("Correlation id found in an empty context")
+	}
+}
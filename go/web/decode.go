@@ -0,0 +1,105 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+// DecodeConfig applies to bodies parsed by ParseParamOrBody. ContentTypes lists the accepted media
+// types, any is accepted when empty.
+type DecodeConfig struct {
+	MaxBytes              *int64   `json:"maxBytes"`
+	DisallowUnknownFields *bool    `json:"disallowUnknownFields"`
+	RejectTrailingData    *bool    `json:"rejectTrailingData"`
+	ContentTypes          []string `json:"contentTypes"`
+}
+
+func DefaultDecodeConfig() DecodeConfig {
+	return DecodeConfig{
+		MaxBytes:              util.PInt64(10 * 1024 * 1024),
+		DisallowUnknownFields: util.PBool(false),
+		RejectTrailingData:    util.PBool(true),
+	}
+}
+
+func (o *DecodeConfig) Validate() {
+	if o.MaxBytes == nil || *o.MaxBytes < 1 {
+		panic("Invalid maxBytes")
+	}
+	if o.DisallowUnknownFields == nil {
+		panic("Invalid disallowUnknownFields")
+	}
+	if o.RejectTrailingData == nil {
+		panic("Invalid rejectTrailingData")
+	}
+}
+
+var decoding = DefaultDecodeConfig()
+
+// ConfigureDecoding sets the limits used by ParseParamOrBody
+func ConfigureDecoding(config DecodeConfig) {
+	config.Validate()
+	decoding = config
+}
+
+func checkContentType(r *http.Request, config DecodeConfig) {
+	if len(config.ContentTypes) == 0 {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	if err == nil {
+		for _, t := range config.ContentTypes {
+			if t == mediaType {
+				return
+			}
+		}
+	}
+	ThrowHttpError(http.StatusUnsupportedMediaType, "Unsupported content type %q", r.Header.Get(HeaderContentType))
+}
+
+func decodeJson(reader io.Reader, o interface{}, config DecodeConfig) {
+	decoder := json.NewDecoder(reader)
+	if *config.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(o); err != nil {
+		checkDecodeErr(err)
+	}
+	if *config.RejectTrailingData {
+		if _, err := decoder.Token(); err != io.EOF {
+			checkDecodeErr(err)
+			ThrowHttpError(http.StatusBadRequest, "Unexpected data after the request body")
+		}
+	}
+}
+
+func checkDecodeErr(err error) {
+	if err == nil {
+		return
+	}
+	var maxBytesError *http.MaxBytesError
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesError):
+		ThrowHttpError(http.StatusRequestEntityTooLarge, "Request body exceeds %d bytes", maxBytesError.Limit)
+	case errors.Is(err, io.EOF):
+		ThrowHttpError(http.StatusBadRequest, "Empty request body")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		ThrowHttpError(http.StatusBadRequest, "Truncated request body")
+	case errors.As(err, &syntaxError):
+		ThrowHttpError(http.StatusBadRequest, "Malformed request body at offset %d", syntaxError.Offset)
+	case errors.As(err, &typeError):
+		ThrowHttpError(http.StatusBadRequest, "Invalid value for field %q", typeError.Field)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		ThrowHttpError(http.StatusBadRequest, "Unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		panic(err)
+	}
+}
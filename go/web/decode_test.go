@@ -0,0 +1,51 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+func TestParseParamOrBodyLimits(t *testing.T) {
+	config := web.DefaultDecodeConfig()
+	config.MaxBytes = util.PInt64(32)
+	config.DisallowUnknownFields = util.PBool(true)
+	config.ContentTypes = []string{web.ContentTypeApplicationJson}
+	handler := web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		entity := struct {
+			Name *string `json:"name"`
+		}{}
+		web.ParseParamOrBodyWith(r, &entity, config)
+		web.JsonResponse(entity, w)
+	})
+
+	cases := []struct {
+		body        string
+		contentType string
+		status      int
+	}{
+		{`{"name":"a"}`, "application/json; charset=utf-8", http.StatusOK},
+		{`{"name":"a"} {"name":"b"}`, web.ContentTypeApplicationJson, http.StatusBadRequest},
+		{`{"name":"a","other":1}`, web.ContentTypeApplicationJson, http.StatusBadRequest},
+		{`{"name":1}`, web.ContentTypeApplicationJson, http.StatusBadRequest},
+		{`{"name":`, web.ContentTypeApplicationJson, http.StatusBadRequest},
+		{``, web.ContentTypeApplicationJson, http.StatusBadRequest},
+		{`{"name":"` + strings.Repeat("a", 64) + `"}`, web.ContentTypeApplicationJson, http.StatusRequestEntityTooLarge},
+		{`{"name":"a"}`, "text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+		request.Header.Set(web.HeaderContentType, c.contentType)
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != c.status {
+			t.Fatalf("%q: expected %d, got %d %s", c.body, c.status, recorder.Code, recorder.Body.String())
+		}
+		if c.status != http.StatusOK && recorder.Header().Get(web.ErrorHeaderName) != "true" {
+			t.Fatalf("%q: error header missing", c.body)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package web
+
+// diskSpace not available, the disk check always passes
+func diskSpace(path string) (uint64, uint64, bool) {
+	return 0, 0, false
+}
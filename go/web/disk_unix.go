@@ -0,0 +1,14 @@
+//go:build unix
+
+package web
+
+import "syscall"
+
+// diskSpace free bytes available to unprivileged users and total bytes of the file system holding path
+func diskSpace(path string) (uint64, uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		panic(err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), true
+}
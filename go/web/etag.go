@@ -0,0 +1,214 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderETag         = "ETag"
+	HeaderIfNoneMatch  = "If-None-Match"
+	HeaderCacheControl = "Cache-Control"
+
+	CacheNoCache = "no-cache"
+	CacheNoStore = "no-store"
+
+	maxETagBufferSize = 8 * 1024 * 1024
+)
+
+// CachePrivate browsers may reuse the response for maxAge without revalidating, shared caches may not store it
+func CachePrivate(maxAge time.Duration) string {
+	return "private, max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+}
+
+func CachePublic(maxAge time.Duration) string {
+	return "public, max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+}
+
+// etagMatches weak comparison as required for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteETag(version string) string {
+	for _, c := range version {
+		if c < '!' || c > '~' || c == '"' {
+			sum := sha256.Sum256([]byte(version))
+			version = base64.RawURLEncoding.EncodeToString(sum[:16])
+			break
+		}
+	}
+	return `"` + version + `"`
+}
+
+func notModified(w http.ResponseWriter) {
+	header := w.Header()
+	for _, name := range []string{HeaderContentType, HeaderContentLength, HeaderContentEncoding} {
+		header.Del(name)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// CheckETag sets a strong ETag built from version, i.e. an updated-at column, and answers 304 when the client
+// already has it. The handler must return right away when true is returned.
+func CheckETag(w http.ResponseWriter, r *http.Request, version string) bool {
+	etag := quoteETag(version)
+	w.Header().Set(HeaderETag, etag)
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get(HeaderIfNoneMatch), etag) {
+		notModified(w)
+		return true
+	}
+	return false
+}
+
+// etagWriter buffers the response to hash it. Responses carrying their own ETag, large ones and flushed ones
+// are passed through.
+type etagWriter struct {
+	http.ResponseWriter
+	status      int
+	buffer      bytes.Buffer
+	passThrough bool
+}
+
+func (o *etagWriter) WriteHeader(status int) {
+	if o.passThrough {
+		o.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status < http.StatusOK {
+		o.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if o.status != 0 {
+		return
+	}
+	o.status = status
+	if status != http.StatusOK || o.Header().Get(HeaderETag) != "" {
+		o.startPassThrough()
+	}
+}
+
+func (o *etagWriter) Write(b []byte) (int, error) {
+	if o.status == 0 {
+		o.WriteHeader(http.StatusOK)
+	}
+	if o.passThrough {
+		return o.ResponseWriter.Write(b)
+	}
+	if o.buffer.Len()+len(b) > maxETagBufferSize {
+		if err := o.startPassThrough(); err != nil {
+			return 0, err
+		}
+		return o.ResponseWriter.Write(b)
+	}
+	return o.buffer.Write(b)
+}
+
+func (o *etagWriter) startPassThrough() error {
+	o.passThrough = true
+	if o.status != 0 {
+		o.ResponseWriter.WriteHeader(o.status)
+	}
+	if o.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := o.ResponseWriter.Write(o.buffer.Bytes())
+	o.buffer.Reset()
+	return err
+}
+
+func (o *etagWriter) Flush() {
+	_ = o.FlushError()
+}
+
+func (o *etagWriter) FlushError() error {
+	if !o.passThrough {
+		if o.status == 0 {
+			o.status = http.StatusOK
+		}
+		if err := o.startPassThrough(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(o.ResponseWriter).Flush()
+}
+
+func (o *etagWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+func (o *etagWriter) held() bool {
+	return !o.passThrough
+}
+
+func (o *etagWriter) discard() {
+	if !o.passThrough {
+		o.status = 0
+		o.buffer.Reset()
+	}
+}
+
+// finish hashes the buffered body into a strong ETag, 304 when it matches If-None-Match
+func (o *etagWriter) finish(r *http.Request) {
+	if o.passThrough {
+		return
+	}
+	if o.status == 0 {
+		// nothing written, let the server send its default 200
+		return
+	}
+	sum := sha256.Sum256(o.buffer.Bytes())
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	header := o.Header()
+	header.Set(HeaderETag, etag)
+	if etagMatches(r.Header.Get(HeaderIfNoneMatch), etag) {
+		notModified(o.ResponseWriter)
+		return
+	}
+	if header.Get(HeaderContentType) == "" {
+		header.Set(HeaderContentType, http.DetectContentType(o.buffer.Bytes()))
+	}
+	header.Set(HeaderContentLength, strconv.Itoa(o.buffer.Len()))
+	o.ResponseWriter.WriteHeader(o.status)
+	_, _ = o.ResponseWriter.Write(o.buffer.Bytes())
+}
+
+// InterceptETag answers conditional GETs. Successful GET and HEAD responses are buffered and hashed into a
+// strong ETag unless the handler set its own through CheckETag. cacheControl is sent unless the handler set
+// Cache-Control, empty means no-cache so clients always revalidate.
+func InterceptETag(cacheControl string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	if cacheControl == "" {
+		cacheControl = CacheNoCache
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			delegate(w, r)
+			return
+		}
+		if w.Header().Get(HeaderCacheControl) == "" {
+			w.Header().Set(HeaderCacheControl, cacheControl)
+		}
+		ew := &etagWriter{ResponseWriter: w}
+		delegate(ew, r)
+		ew.finish(r)
+	}
+}
+
+func ConfigureHandlerETag(serveMux *http.ServeMux, path string, cacheControl string, f func(w http.ResponseWriter, r *http.Request)) {
+	HandleDefault(serveMux, path, InterceptETag(cacheControl, f))
+}
@@ -0,0 +1,68 @@
+package web_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	calls := 0
+	mux := http.NewServeMux()
+	web.ConfigureHandlerETag(mux, "/items", web.CachePrivate(time.Minute), func(w http.ResponseWriter, r *http.Request) {
+		web.JsonResponse(map[string]string{"name": "item"}, w)
+	})
+	web.ConfigureHandlerETag(mux, "/versioned", "", func(w http.ResponseWriter, r *http.Request) {
+		if web.CheckETag(w, r, "2024-01-02T03:04:05Z") {
+			return
+		}
+		calls++
+		web.JsonResponse(map[string]string{"name": "versioned"}, w)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string, etag string) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if etag != "" {
+			request.Header.Set(web.HeaderIfNoneMatch, etag)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.ReadAll(response.Body)
+		response.Body.Close()
+		return response
+	}
+
+	response := get("/items", "")
+	etag := response.Header.Get(web.HeaderETag)
+	if response.StatusCode != http.StatusOK || etag == "" || response.Header.Get(web.HeaderCacheControl) != "private, max-age=60" {
+		t.Fatalf("Unexpected response %d %v", response.StatusCode, response.Header)
+	}
+	if response = get("/items", etag); response.StatusCode != http.StatusNotModified || response.Header.Get(web.HeaderETag) != etag {
+		t.Fatalf("Unexpected response %d %v", response.StatusCode, response.Header)
+	}
+	if response = get("/items", `"other", W/`+etag); response.StatusCode != http.StatusNotModified {
+		t.Fatalf("Unexpected status %d for a weak match", response.StatusCode)
+	}
+	if response = get("/items", `"other"`); response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d for a different tag", response.StatusCode)
+	}
+
+	response = get("/versioned", "")
+	if response.StatusCode != http.StatusOK || response.Header.Get(web.HeaderETag) != `"2024-01-02T03:04:05Z"` ||
+		response.Header.Get(web.HeaderCacheControl) != web.CacheNoCache {
+		t.Fatalf("Unexpected response %d %v", response.StatusCode, response.Header)
+	}
+	if response = get("/versioned", `"2024-01-02T03:04:05Z"`); response.StatusCode != http.StatusNotModified {
+		t.Fatalf("Unexpected status %d", response.StatusCode)
+	}
+	if calls != 1 {
+		t.Fatalf("Unexpected %d calls", calls)
+	}
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+
+	HealthLivePath  = "/health/live"
+	HealthReadyPath = "/health/ready"
+)
+
+// HealthCheck Check panics when the dependency is not usable, it should give up once ctx is done
+type HealthCheck struct {
+	Name    string
+	Timeout time.Duration
+	Check   func(ctx context.Context)
+}
+
+type HealthResult struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latencyMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string         `json:"status"`
+	Checks []HealthResult `json:"checks"`
+}
+
+// Health the readiness checks, run concurrently on every readiness probe
+type Health struct {
+	checks []HealthCheck
+	mux    *sync.Mutex
+}
+
+func (o *Health) AddCheck(name string, timeout time.Duration, check func(ctx context.Context)) {
+	if timeout <= 0 {
+		panic("Invalid timeout")
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.checks = append(o.checks, HealthCheck{Name: name, Timeout: timeout, Check: check})
+}
+
+func runHealthCheck(ctx context.Context, check HealthCheck) HealthResult {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	t0 := time.Now()
+	done := make(chan string, 1)
+	go func() {
+		message := ""
+		defer func() {
+			if e := recover(); e != nil {
+				message = fmt.Sprint(e)
+			}
+			done <- message
+		}()
+		check.Check(ctx)
+	}()
+	result := HealthResult{Name: check.Name, Status: HealthUp}
+	select {
+	case message := <-done:
+		if message != "" {
+			result.Status = HealthDown
+			result.Error = message
+		}
+	case <-ctx.Done():
+		result.Status = HealthDown
+		result.Error = fmt.Sprintf("Timed out after %v", check.Timeout)
+	}
+	result.Latency = float64(time.Since(t0).Microseconds()) / 1000
+	return result
+}
+
+// Report down when any check is down
+func (o *Health) Report(ctx context.Context) HealthReport {
+	o.mux.Lock()
+	checks := append([]HealthCheck{}, o.checks...)
+	o.mux.Unlock()
+	report := HealthReport{Status: HealthUp, Checks: make([]HealthResult, len(checks))}
+	wg := &sync.WaitGroup{}
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report.Checks[i] = runHealthCheck(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != HealthUp {
+			report.Status = HealthDown
+		}
+	}
+	return report
+}
+
+func NewHealth() *Health {
+	return &Health{mux: &sync.Mutex{}}
+}
+
+// NewDefaultHealth checks the databases, the sessions when sessionManager is not nil and its data provider
+// implements auth.HealthChecker, and the disk space left for the logs
+func NewDefaultHealth(sessionManager *auth.SessionManager) *Health {
+	health := NewHealth()
+	health.AddCheck("databases", 2*time.Second, DatabasesCheck)
+	if sessionManager != nil && sessionManager.HealthCheckable() {
+		health.AddCheck("sessions", 2*time.Second, SessionsCheck(sessionManager))
+	}
+	logDir := "."
+	if fileName := util.LogFileName(); fileName != "" {
+		logDir = filepath.Dir(fileName)
+	}
+	health.AddCheck("disk", time.Second, DiskSpaceCheck(logDir, 100*1024*1024))
+	return health
+}
+
+// DatabasesCheck pings every pool opened through sql.GlobalDatabases
+func DatabasesCheck(ctx context.Context) {
+	failures := make([]string, 0)
+	for name, err := range sql.GlobalDatabases.Ping(ctx) {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		panic(strings.Join(failures, "; "))
+	}
+}
+
+// SessionsCheck the session store answers, see auth.HealthChecker
+func SessionsCheck(sessionManager *auth.SessionManager) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		sessionManager.CheckHealth(ctx)
+	}
+}
+
+// DiskSpaceCheck fails when less than minFree bytes are available in the file system holding path
+func DiskSpaceCheck(path string, minFree uint64) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		free, _, ok := diskSpace(path)
+		if ok && free < minFree {
+			panic(fmt.Sprintf("%d MB free in %s, at least %d MB required", free/1024/1024, path, minFree/1024/1024))
+		}
+	}
+}
+
+func healthResponse(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set(HeaderContentType, ContentTypeApplicationJson)
+	w.Header().Set(HeaderCacheControl, CacheNoStore)
+	if report.Status != HealthUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	util.JsonEncode(report, w)
+}
+
+// ConfigureHealth serves liveness at livePath, up while the process can answer, and readiness at readyPath.
+// Readiness runs the checks and is down once the server starts shutting down so load balancers stop routing to it.
+func ConfigureHealth(serveMux *http.ServeMux, livePath string, readyPath string, health *Health) {
+	HandleDefault(serveMux, livePath, func(w http.ResponseWriter, r *http.Request) {
+		healthResponse(w, HealthReport{Status: HealthUp, Checks: []HealthResult{}})
+	})
+	HandleDefault(serveMux, readyPath, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-serverStopping(r):
+			healthResponse(w, HealthReport{Status: HealthDown, Checks: []HealthResult{{Name: "server", Status: HealthDown, Error: "Shutting down"}}})
+			return
+		default:
+		}
+		healthResponse(w, health.Report(r.Context()))
+	})
+}
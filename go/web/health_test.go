@@ -0,0 +1,133 @@
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	health := web.NewDefaultHealth(nil)
+	failing := false
+	health.AddCheck("queue", time.Second, func(ctx context.Context) {
+		if failing {
+			panic("Queue unreachable")
+		}
+	})
+	health.AddCheck("slow", 20*time.Millisecond, func(ctx context.Context) {
+		if failing {
+			<-ctx.Done()
+		}
+	})
+	mux := http.NewServeMux()
+	web.ConfigureHealth(mux, web.HealthLivePath, web.HealthReadyPath, health)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, web.HealthReport) {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		report := web.HealthReport{}
+		if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, report
+	}
+
+	status, report := get(web.HealthReadyPath)
+	if status != http.StatusOK || report.Status != web.HealthUp || len(report.Checks) != 4 {
+		t.Fatalf("Unexpected readiness %d %+v", status, report)
+	}
+	failing = true
+	status, report = get(web.HealthReadyPath)
+	if status != http.StatusServiceUnavailable || report.Status != web.HealthDown {
+		t.Fatalf("Unexpected readiness %d %+v", status, report)
+	}
+	expected := map[string]string{"databases": web.HealthUp, "disk": web.HealthUp, "queue": web.HealthDown, "slow": web.HealthDown}
+	for _, check := range report.Checks {
+		if expected[check.Name] != check.Status {
+			t.Fatalf("Unexpected check %+v", check)
+		}
+	}
+	if status, report = get(web.HealthLivePath); status != http.StatusOK || report.Status != web.HealthUp {
+		t.Fatalf("Unexpected liveness %d %+v", status, report)
+	}
+}
+
+type sessionsProvider struct {
+	failing bool
+}
+
+func (o *sessionsProvider) LoadSnapshot() map[string]*auth.SessionEntry {
+	panic("Snapshot loaded by a health check")
+}
+
+func (o *sessionsProvider) CreateSession(entry *auth.SessionEntry) int64 {
+	return 0
+}
+
+func (o *sessionsProvider) UpdateSessionTime(id int64, expirationTime time.Time, lastTime time.Time) {
+}
+
+func (o *sessionsProvider) RemoveSession(entry *auth.SessionEntry) {
+}
+
+func (o *sessionsProvider) Shrink() {
+}
+
+type checkedSessionsProvider struct {
+	sessionsProvider
+	checks int
+}
+
+func (o *checkedSessionsProvider) CheckHealth(ctx context.Context) {
+	o.checks++
+	if o.failing {
+		panic("Sessions store unreachable")
+	}
+}
+
+func TestSessionsHealth(t *testing.T) {
+	sessionsStatus := func(provider auth.DataProvider) string {
+		report := web.NewDefaultHealth(auth.NewSessionManager(provider, auth.SessionsConfig{})).Report(context.Background())
+		for _, check := range report.Checks {
+			if check.Name == "sessions" {
+				return check.Status
+			}
+		}
+		return ""
+	}
+
+	// providers without a health check are not checked
+	if status := sessionsStatus(&sessionsProvider{}); status != "" {
+		t.Fatalf("Unexpected sessions status %s without a health check", status)
+	}
+
+	checked := &checkedSessionsProvider{}
+	if status := sessionsStatus(checked); status != web.HealthUp || checked.checks != 1 {
+		t.Fatalf("Unexpected sessions status %s after %d checks", status, checked.checks)
+	}
+	checked.failing = true
+	if status := sessionsStatus(checked); status != web.HealthDown || checked.checks != 2 {
+		t.Fatalf("Unexpected sessions status %s after %d checks with the store down", status, checked.checks)
+	}
+
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Check added with timeout %v", timeout)
+				}
+			}()
+			web.NewHealth().AddCheck("invalid", timeout, func(ctx context.Context) {})
+		}()
+	}
+}
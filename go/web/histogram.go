@@ -0,0 +1,84 @@
+package web
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Log-linear buckets over microseconds: values below histogramSubBuckets get a bucket each, above
+// that every power of two is split in histogramSubBuckets linear buckets (~12% relative error).
+// Memory is fixed regardless of the amount of samples.
+const (
+	histogramSubBucketBits = 3
+	histogramSubBuckets    = 1 << histogramSubBucketBits
+	histogramMaxExponent   = 40
+	histogramBuckets       = (histogramMaxExponent - histogramSubBucketBits + 2) * histogramSubBuckets
+)
+
+type latencyHistogram struct {
+	counts [histogramBuckets]int64
+	count  int64
+	max    int64
+}
+
+func histogramIndex(micros int64) int {
+	if micros < histogramSubBuckets {
+		return int(micros)
+	}
+	exponent := bits.Len64(uint64(micros)) - 1
+	if exponent > histogramMaxExponent {
+		return histogramBuckets - 1
+	}
+	mantissa := int(micros>>(exponent-histogramSubBucketBits)) & (histogramSubBuckets - 1)
+	return (exponent-histogramSubBucketBits+1)*histogramSubBuckets + mantissa
+}
+
+func histogramUpperBound(index int) int64 {
+	if index < histogramSubBuckets {
+		return int64(index)
+	}
+	exponent := index/histogramSubBuckets + histogramSubBucketBits - 1
+	mantissa := int64(index % histogramSubBuckets)
+	width := int64(1) << (exponent - histogramSubBucketBits)
+	return (histogramSubBuckets+mantissa)*width + width - 1
+}
+
+func (o *latencyHistogram) Record(d time.Duration) {
+	micros := d.Microseconds()
+	if micros < 0 {
+		micros = 0
+	}
+	o.counts[histogramIndex(micros)]++
+	o.count++
+	if micros > o.max {
+		o.max = micros
+	}
+}
+
+// Percentile in milliseconds, p in (0, 1]. Values are bucket upper bounds capped to the max seen.
+func (o *latencyHistogram) Percentile(p float64) float64 {
+	if o.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p * float64(o.count)))
+	if target < 1 {
+		target = 1
+	}
+	var accum int64
+	for i, c := range o.counts {
+		accum += c
+		if accum >= target {
+			return float64(min(histogramUpperBound(i), o.max)) / 1000
+		}
+	}
+	return o.Max()
+}
+
+func (o *latencyHistogram) Max() float64 {
+	return float64(o.max) / 1000
+}
+
+func (o *latencyHistogram) Reset() {
+	*o = latencyHistogram{}
+}
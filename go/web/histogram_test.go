@@ -0,0 +1,71 @@
+package web
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	for micros := int64(0); micros < 1<<20; micros++ {
+		index := histogramIndex(micros)
+		upper := histogramUpperBound(index)
+		if upper < micros || histogramIndex(upper) != index || histogramIndex(upper+1) != index+1 {
+			t.Fatalf("Value %d in bucket %d with upper bound %d", micros, index, upper)
+		}
+	}
+	if index := histogramIndex(math.MaxInt64); index != histogramBuckets-1 {
+		t.Fatalf("Unexpected bucket %d for the largest value", index)
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	distributions := map[string]func(i int) int64{
+		"constant":    func(i int) int64 { return 1500 },
+		"uniform":     func(i int) int64 { return int64(i%10000) * 1000 },
+		"exponential": func(i int) int64 { return int64(random.ExpFloat64() * 20000) },
+		"bimodal": func(i int) int64 {
+			if i%10 == 0 {
+				return 2000000 + random.Int63n(1000000)
+			}
+			return 5000 + random.Int63n(1000)
+		},
+		"tiny": func(i int) int64 { return int64(i % 8) },
+	}
+	for name, distribution := range distributions {
+		histogram := latencyHistogram{}
+		samples := make([]int64, 100000)
+		for i := range samples {
+			samples[i] = distribution(i)
+			histogram.Record(time.Duration(samples[i]) * time.Microsecond)
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		for _, p := range []float64{0.01, 0.5, 0.9, 0.99, 0.999, 1} {
+			exact := float64(samples[int(math.Ceil(p*float64(len(samples))))-1]) / 1000
+			// values are bucket upper bounds, never below the exact one and at most one eighth above it
+			if got := histogram.Percentile(p); got < exact || got > exact*1.125+0.001 {
+				t.Fatalf("%s p%v %v, expected %v", name, p*100, got, exact)
+			}
+		}
+		if histogram.Percentile(1) != histogram.Max() || histogram.Max() != float64(samples[len(samples)-1])/1000 {
+			t.Fatalf("%s max %v, p100 %v", name, histogram.Max(), histogram.Percentile(1))
+		}
+	}
+
+	histogram := latencyHistogram{}
+	if histogram.Percentile(0.5) != 0 || histogram.Max() != 0 {
+		t.Fatal("Empty histogram not zero")
+	}
+	histogram.Record(-time.Second)
+	histogram.Record(time.Duration(1<<45) * time.Microsecond)
+	if histogram.Percentile(0.5) != 0 || histogram.Max() != float64(int64(1)<<45)/1000 {
+		t.Fatalf("Unexpected p50 %v and max %v out of range", histogram.Percentile(0.5), histogram.Max())
+	}
+	histogram.Reset()
+	if histogram.count != 0 || histogram.Percentile(1) != 0 {
+		t.Fatal("Histogram not reset")
+	}
+}
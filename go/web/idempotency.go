@@ -0,0 +1,324 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/tx"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	IdempotentReplayedHeaderName = "Idempotent-Replayed"
+	maxIdempotencyKeyLength      = 255
+	idempotencyTableSql          = `create table if not exists %s (
+	key text primary key,
+	fingerprint text not null,
+	status integer,
+	headers text,
+	body bytea,
+	locked_until timestamptz not null,
+	expires timestamptz not null
+)`
+)
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// IdempotencyConfig Ttl is how long, in seconds, a completed key replays its response. LockTimeout is how long
+// a key stays claimed by a request that never finished, i.e. the process died.
+type IdempotencyConfig struct {
+	Table           *string `json:"table"`
+	Ttl             *int    `json:"ttl"`
+	LockTimeout     *int    `json:"lockTimeout"`
+	MaxResponseSize *int    `json:"maxResponseSize"`
+	Required        *bool   `json:"required"`
+}
+
+func DefaultIdempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{
+		Table:           util.PStr("idempotency_key"),
+		Ttl:             util.PInt(24 * 60 * 60),
+		LockTimeout:     util.PInt(5 * 60),
+		MaxResponseSize: util.PInt(1024 * 1024),
+		Required:        util.PBool(false),
+	}
+}
+
+func (o *IdempotencyConfig) Validate() {
+	if o.Table == nil || !tableNameRegexp.MatchString(*o.Table) {
+		panic("Invalid table")
+	}
+	if o.Ttl == nil || *o.Ttl <= 0 {
+		panic("Invalid ttl")
+	}
+	if o.LockTimeout == nil || *o.LockTimeout <= 0 {
+		panic("Invalid lockTimeout")
+	}
+	if o.MaxResponseSize == nil || *o.MaxResponseSize <= 0 {
+		panic("Invalid maxResponseSize")
+	}
+	if o.Required == nil {
+		panic("Invalid required")
+	}
+}
+
+// CreateIdempotencyTable creates the table holding the keys if it does not exist
+func CreateIdempotencyTable(trx *tx.Transaction, config IdempotencyConfig) {
+	config.Validate()
+	trx.Exec(fmt.Sprintf(idempotencyTableSql, *config.Table))
+}
+
+// PurgeIdempotencyKeys deletes the expired keys, expired keys are also reclaimed by new requests so this only
+// keeps the table small
+func PurgeIdempotencyKeys(trx *tx.Transaction, config IdempotencyConfig) {
+	config.Validate()
+	trx.Exec(fmt.Sprintf("delete from %s where expires < now() and (status is not null or locked_until < now())", *config.Table))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyScope keys are per user or client so one caller cannot replay another one's responses
+func idempotencyScope(r *http.Request) string {
+	sessionEntry := r.Context().Value("sessionEntry")
+	if sessionEntry != nil && sessionEntry.(*auth.SessionEntry).UserId != nil {
+		return fmt.Sprintf("user:%d", *sessionEntry.(*auth.SessionEntry).UserId)
+	}
+	if clientId, ok := r.Context().Value("clientId").(string); ok && clientId != "" {
+		return "client:" + clientId
+	}
+	if username, ok := r.Context().Value("username").(string); ok && username != "" {
+		return "basic:" + username
+	}
+	return "anonymous"
+}
+
+// idempotencyFingerprint method, path, query and body digest. The body is read and restored for the handler.
+func idempotencyFingerprint(r *http.Request) string {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, *decoding.MaxBytes))
+	util.CheckErr(err)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256([]byte(r.Method + "\n" + r.URL.EscapedPath() + "\n" + canonicalQuery(r.URL.Query()) + "\n" + BodyDigest(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyWriter holds the response back until the stored copy commits, so clients never see a response
+// whose key was not stored. 5xx responses and responses larger than maxSize are not stored and pass through.
+type idempotencyWriter struct {
+	http.ResponseWriter
+	maxSize     int
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	passThrough bool
+	overflow    bool
+}
+
+func (o *idempotencyWriter) WriteHeader(status int) {
+	if o.status != 0 || status < http.StatusOK {
+		if o.passThrough {
+			o.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	o.status = status
+	o.header = o.ResponseWriter.Header().Clone()
+	if status >= http.StatusInternalServerError {
+		o.passThrough = true
+		o.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (o *idempotencyWriter) Write(b []byte) (int, error) {
+	if o.status == 0 {
+		o.WriteHeader(http.StatusOK)
+	}
+	if o.passThrough {
+		return o.ResponseWriter.Write(b)
+	}
+	if o.body.Len()+len(b) > o.maxSize {
+		o.overflow = true
+		o.passThrough = true
+		o.ResponseWriter.WriteHeader(o.status)
+		if _, err := o.ResponseWriter.Write(o.body.Bytes()); err != nil {
+			return 0, err
+		}
+		o.body.Reset()
+		return o.ResponseWriter.Write(b)
+	}
+	return o.body.Write(b)
+}
+
+func (o *idempotencyWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+// flush sends the response held back
+func (o *idempotencyWriter) flush() {
+	if o.passThrough {
+		return
+	}
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	o.ResponseWriter.WriteHeader(o.status)
+	util.Write(o.ResponseWriter, o.body.Bytes())
+}
+
+// storedHeaders the headers worth replaying, the ones set per response or by outer interceptors are dropped
+func (o *idempotencyWriter) storedHeaders() string {
+	header := o.header
+	if header == nil {
+		header = o.ResponseWriter.Header().Clone()
+	}
+	for _, name := range []string{CorrelationIdHeaderName, HeaderContentEncoding, HeaderContentLength, HeaderVary, "Date", "Set-Cookie", "Access-Control-Allow-Origin"} {
+		header.Del(name)
+	}
+	return string(util.Marshal(header))
+}
+
+type idempotency struct {
+	config     IdempotencyConfig
+	claimSql   string
+	findSql    string
+	storeSql   string
+	releaseSql string
+}
+
+func newIdempotency(config IdempotencyConfig) *idempotency {
+	config.Validate()
+	table := *config.Table
+	return &idempotency{
+		config: config,
+		claimSql: fmt.Sprintf(`insert into %[1]s as t (key, fingerprint, locked_until, expires)
+values ($1, $2, now() + $3 * interval '1 second', now() + $4 * interval '1 second')
+on conflict (key) do update set fingerprint = excluded.fingerprint, status = null, headers = null, body = null,
+	locked_until = excluded.locked_until, expires = excluded.expires
+where t.expires < now() or (t.status is null and t.locked_until < now())`, table),
+		findSql:    fmt.Sprintf("select fingerprint, status, headers, body from %s where key = $1", table),
+		storeSql:   fmt.Sprintf("update %s set status = $2, headers = $3, body = $4 where key = $1", table),
+		releaseSql: fmt.Sprintf("delete from %s where key = $1 and status is null", table),
+	}
+}
+
+// claim runs outside the handler transaction so concurrent duplicates see the key right away
+func (o *idempotency) claim(trx *tx.Transaction, key string, fingerprint string) bool {
+	result, err := trx.Db().Exec(o.claimSql, key, fingerprint, *o.config.LockTimeout, *o.config.Ttl)
+	util.CheckErr(err)
+	n, err := result.RowsAffected()
+	util.CheckErr(err)
+	return n == 1
+}
+
+func (o *idempotency) release(trx *tx.Transaction, r *http.Request, key string) {
+	defer func() {
+		if e := recover(); e != nil {
+			util.ProcessErrorContext(r.Context(), e, "error")
+		}
+	}()
+	_, err := trx.Db().Exec(o.releaseSql, key)
+	util.CheckErr(err)
+}
+
+// replay writes the stored response, a key still in progress is a 409 and a key reused with a different
+// request is a 422
+func (o *idempotency) replay(trx *tx.Transaction, w http.ResponseWriter, key string, fingerprint string) {
+	var storedFingerprint string
+	var status *int64
+	var headers *string
+	var body []byte
+	if !trx.Singleton(o.findSql, []interface{}{&storedFingerprint, &status, &headers, &body}, key) {
+		ThrowHttpError(http.StatusConflict, "Request with the same %s is in progress", HeaderIdempotencyKey)
+	}
+	if storedFingerprint != fingerprint {
+		ThrowHttpError(http.StatusUnprocessableEntity, "%s was already used with a different request", HeaderIdempotencyKey)
+	}
+	if status == nil {
+		ThrowHttpError(http.StatusConflict, "Request with the same %s is in progress", HeaderIdempotencyKey)
+	}
+	if headers != nil {
+		stored := make(http.Header)
+		util.CheckErr(json.Unmarshal([]byte(*headers), &stored))
+		for name, values := range stored {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(IdempotentReplayedHeaderName, "true")
+	w.WriteHeader(int(*status))
+	util.Write(w, body)
+}
+
+// InterceptIdempotent replays the stored response of requests carrying an already used Idempotency-Key.
+// The response is stored in the handler transaction and only sent once it commits, failed requests release
+// the key and can be retried. 5xx responses and responses larger than MaxResponseSize are not stored either
+// and are sent right away. A failed commit answers 500 and leaves the key claimed until LockTimeout. The
+// table is created by CreateIdempotencyTable.
+func InterceptIdempotent(config IdempotencyConfig, delegate func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request) {
+	idempotency := newIdempotency(config)
+	return func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HeaderIdempotencyKey)
+		if key == "" {
+			if *idempotency.config.Required {
+				ThrowHttpError(http.StatusBadRequest, "Missing %s header", HeaderIdempotencyKey)
+			}
+			delegate(trx, w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			ThrowHttpError(http.StatusBadRequest, "Invalid %s header", HeaderIdempotencyKey)
+		}
+		key = idempotencyScope(r) + ":" + key
+		fingerprint := idempotencyFingerprint(r)
+		if !idempotency.claim(trx, key, fingerprint) {
+			idempotency.replay(trx, w, key, fingerprint)
+			return
+		}
+		stored := false
+		defer func() {
+			if !stored {
+				idempotency.release(trx, r, key)
+			}
+		}()
+		iw := &idempotencyWriter{ResponseWriter: w, maxSize: *idempotency.config.MaxResponseSize}
+		delegate(trx, iw, r)
+		status := iw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		if iw.overflow {
+			util.LogContext(r.Context(), "warning").Printf("Response to %s is larger than %d bytes, %s not stored", r.URL.Path, *idempotency.config.MaxResponseSize, HeaderIdempotencyKey)
+			return
+		}
+		trx.Exec(idempotency.storeSql, key, status, iw.storedHeaders(), iw.body.Bytes())
+		stored = true
+		trx.AddFuture(iw.flush)
+	}
+}
+
+func ConfigureHandlerIdempotentTransactional(serveMux *http.ServeMux, path string, databaseConfig sql.DatasourceConfig, config IdempotencyConfig, f func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) {
+	ConfigureHandlerTransactional(serveMux, path, databaseConfig, InterceptIdempotent(config, f))
+}
+
+func ConfigureHandlerAuthenticatedIdempotentTransactional(serveMux *http.ServeMux, path string, sessionManager *auth.SessionManager, databaseConfig sql.DatasourceConfig, config IdempotencyConfig, f func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) {
+	ConfigureHandlerAuthenticatedTransactional(serveMux, path, sessionManager, databaseConfig, InterceptIdempotent(config, f))
+}
@@ -2,9 +2,11 @@ package web
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -59,66 +61,205 @@ func InterceptSecret(secret string, delegate func(w http.ResponseWriter, r *http
 	}
 }
 
+// InterceptSecretHeader accepts the secret only from the secret header, so it never ends up in access logs or
+// browser history, and answers 401 when it is missing or wrong
+func InterceptSecretHeader(secret string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		incoming := r.Header.Get("secret")
+		if incoming == "" || subtle.ConstantTimeCompare([]byte(incoming), []byte(secret)) != 1 {
+			ThrowHttpError(http.StatusUnauthorized, "Invalid credentials")
+		}
+		delegate(w, r)
+	}
+}
+
 func InterceptFatal(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
-	return InterceptStats(func(w http.ResponseWriter, r *http.Request) {
-		defer catchFatal(w, r)
+	return InterceptStats(InterceptCorrelation(interceptCompressionIfConfigured(func(w http.ResponseWriter, r *http.Request) {
+		cw := &committedWriter{ResponseWriter: w}
+		defer catchFatal(cw, r)
 		defer func() {
 			err := r.Body.Close()
 			if err != nil {
-				util.Log("error").Printf("Could not close response body: %v", err)
+				util.LogContext(r.Context(), "error").Printf("Could not close response body: %v", err)
 			}
 		}()
-		delegate(w, r)
-	})
+		delegate(cw, r)
+	})))
+}
+
+// committedWriter tracks whether the status or part of the body was sent, from then on an error response
+// can no longer be written
+type committedWriter struct {
+	http.ResponseWriter
+	committed bool
+}
+
+func (o *committedWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		o.committed = true
+	}
+	o.ResponseWriter.WriteHeader(status)
+}
+
+func (o *committedWriter) Write(b []byte) (int, error) {
+	o.committed = true
+	return o.ResponseWriter.Write(b)
+}
+
+func (o *committedWriter) Flush() {
+	_ = o.FlushError()
+}
+
+func (o *committedWriter) FlushError() error {
+	o.committed = true
+	return http.NewResponseController(o.ResponseWriter).Flush()
+}
+
+func (o *committedWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+// heldResponse writers buffering the response, i.e. for compression, until they decide to send it
+type heldResponse interface {
+	held() bool
+	discard()
+}
+
+// ResponseCommitted true once the handler sent the status or part of the body through a writer
+// provided by InterceptFatal and no writer below it is still holding them back
+func ResponseCommitted(w http.ResponseWriter) bool {
+	committed := false
+	for {
+		switch v := w.(type) {
+		case *committedWriter:
+			if !v.committed {
+				return false
+			}
+			committed = true
+			w = v.Unwrap()
+		case heldResponse:
+			if v.held() {
+				return false
+			}
+			w = v.(interface{ Unwrap() http.ResponseWriter }).Unwrap()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return committed
+		}
+	}
+}
+
+// discardHeldResponse drops what the writers down the chain hold so an error response can replace it
+func discardHeldResponse(w http.ResponseWriter) {
+	for {
+		if v, ok := w.(heldResponse); ok {
+			v.discard()
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
 }
 
 func InterceptStats(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		t0 := time.Now()
-		stats.PushIn(r.URL.Path)
+		route := routeKey(r)
+		stats.PushIn(route)
+		metrics.PushIn(route, r.Method)
+		sw := &statsWriter{ResponseWriter: w}
+		r = withRequestInfo(r)
 		defer func() {
 			t1 := time.Now()
-			d := t1.Sub(t0).Milliseconds()
-			stats.PushOut(r.URL.Path, d)
+			d := t1.Sub(t0)
+			if accessLog != nil {
+				accessLog.record(sw, r, t0, d)
+			}
+			if sw.streaming {
+				stats.PushStreamOut(route, d, sw.Status())
+				metrics.PushStreamOut(route, r.Method, sw.Status())
+			} else {
+				stats.PushOut(route, d, sw.Status())
+				metrics.PushOut(route, r.Method, sw.Status(), d)
+			}
 		}()
-		delegate(w, r)
+		delegate(sw, r)
 	}
 }
 
+// catchFatal writes the error response. Once the response is committed the connection is aborted instead,
+// so the client sees a failed response rather than an error appended to a partial body.
 func catchFatal(writer http.ResponseWriter, r *http.Request) {
 	if e := recover(); e != nil {
-		util.ProcessError(e, "error")
-		writer.WriteHeader(http.StatusInternalServerError)
+		if e == http.ErrAbortHandler {
+			panic(e)
+		}
+		if ResponseCommitted(writer) {
+			util.ProcessErrorContext(r.Context(), e, "error")
+			util.LogContext(r.Context(), "warning").Printf("%s %s: response already committed, aborting the connection", r.Method, r.URL.Path)
+			panic(http.ErrAbortHandler)
+		}
+		discardHeldResponse(writer)
+		if httpError, ok := asHttpError(e); ok {
+			writeHttpError(writer, r, httpError)
+			return
+		}
+		util.ProcessErrorContext(r.Context(), e, "error")
+		var body []byte
 		if err, ok := e.(util.FriendlyErrorMessage); ok {
 			writer.Header().Set(HeaderContentType, ContentTypeApplicationJson)
 			writer.Header().Set(ErrorHeaderName, "true")
-			util.JsonEncode(err, writer)
-		} else if err, ok := e.(FriendlyErrorResponse); ok {
-			writer.Header().Set(HeaderContentType, ContentTypeApplicationJson)
-			writer.Header().Set(ErrorHeaderName, "true")
-			util.JsonEncode(err, writer)
-		} else if reflect.TypeOf(r).Kind() == reflect.Struct {
-			isJson, jsonBytes := marshalError(r)
+			body = util.Marshal(err)
+		} else if reflect.TypeOf(e).Kind() == reflect.Struct {
+			isJson, jsonBytes := marshalError(e)
 			if isJson {
 				writer.Header().Set(HeaderContentType, ContentTypeApplicationJson)
 			} else {
 				writer.Header().Set(HeaderContentType, "text/plain")
 			}
-			_, err := writer.Write(jsonBytes)
-			if err != nil {
-				util.ProcessError(err)
-			}
+			body = jsonBytes
 		} else {
-			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			writer.Write([]byte(fmt.Sprint(e)))
+			writer.Header().Set(HeaderContentType, "text/plain; charset=utf-8")
+			body = []byte(fmt.Sprint(e))
 		}
+		writer.Header().Del(HeaderContentLength)
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, err := writer.Write(body)
+		if err != nil {
+			util.ProcessError(err)
+		}
+	}
+}
+
+func writeHttpError(writer http.ResponseWriter, r *http.Request, httpError HttpError) {
+	if httpError.StatusCode >= http.StatusInternalServerError {
+		util.ProcessErrorContext(r.Context(), httpError.Error, "error")
+	} else {
+		util.LogContext(r.Context(), "warning").Printf("%s %s: %d %v", r.Method, r.URL.Path, httpError.StatusCode, httpError.Error)
 	}
+	body := httpError.Error
+	switch v := body.(type) {
+	case nil:
+		body = util.FriendlyErrorMessage{ErrorMessage: http.StatusText(httpError.StatusCode)}
+	case string:
+		body = util.FriendlyErrorMessage{ErrorMessage: v}
+	}
+	writer.Header().Set(HeaderContentType, ContentTypeApplicationJson)
+	writer.Header().Set(ErrorHeaderName, "true")
+	writer.Header().Del(HeaderContentLength)
+	writer.WriteHeader(httpError.StatusCode)
+	util.JsonEncode(body, writer)
 }
 
 func marshalError(e interface{}) (isJson bool, result []byte) {
 	defer func() {
-		isJson = false
-		result = []byte(fmt.Sprintf("%v", e))
+		if recover() != nil {
+			isJson = false
+			result = []byte(fmt.Sprintf("%v", e))
+		}
 	}()
 	return true, util.Marshal(e)
 }
@@ -145,6 +286,10 @@ func InterceptAudit(delegate func(tx *tx.Transaction, w http.ResponseWriter, r *
 			tx.Exec(fmt.Sprintf("set local audit.user_name to '%d';", *sessionEntry.(*auth.SessionEntry).UserId))
 		}
 		tx.Exec(fmt.Sprintf("set local audit.context to '%s';", r.URL.Path))
+		correlationId := util.CorrelationId(r.Context())
+		if correlationId != "" {
+			tx.Exec("select set_config('audit.correlation_id', $1, true);", correlationId)
+		}
 		delegate(tx, w, r)
 	}
 }
@@ -155,6 +300,9 @@ func InterceptAuth(sessionManager *auth.SessionManager, delegate func(w http.Res
 		if tokenEntry == nil {
 			w.WriteHeader(http.StatusUnauthorized)
 		} else {
+			if tokenEntry.UserId != nil {
+				setRequestUser(r, strconv.FormatInt(*tokenEntry.UserId, 10))
+			}
 			ctx := context.WithValue(r.Context(), "sessionEntry", tokenEntry)
 			delegate(w, r.WithContext(ctx))
 		}
@@ -189,21 +337,21 @@ func resolveToken(r *http.Request) (string, bool) {
 	return "", false
 }
 
+// InterceptSigned verifies version 2 signatures against a single secret, use InterceptSignedWith to rotate secrets
 func InterceptSigned(secret string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		clientId := r.Header.Get(ClientIdHeaderName)
-		timestamp := r.Header.Get(TimestampHeaderName)
-		signature := r.Header.Get(SignatureHeaderName)
-		computed := CreateSignature(secret, []byte(clientId+"."+timestamp))
+	return InterceptSignedWith(NewSignatureVerifier(StaticSecrets(secret)), delegate)
+}
 
-		if strings.Compare(signature, computed) != 0 {
-			panic("Invalid signature")
-		}
-		ctx := context.WithValue(r.Context(), "clientId", clientId)
-		delegate(w, r.WithContext(ctx))
-	}
+// InterceptSignedLegacy same as InterceptSigned but also accepting legacy signatures within MaxSkew, only meant
+// for clients not migrated yet since legacy signatures neither cover the body nor prevent replays
+func InterceptSignedLegacy(secret string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	verifier := NewSignatureVerifier(StaticSecrets(secret))
+	verifier.AllowLegacy = true
+	return InterceptSignedWith(verifier, delegate)
 }
 
+// InterceptBasicAuth leaves the password check to the delegate, so the username is only recorded as the request
+// user once the delegate returned without rejecting the credentials
 func InterceptBasicAuth(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		inUsername, inPw, ok := r.BasicAuth()
@@ -213,6 +361,9 @@ func InterceptBasicAuth(delegate func(w http.ResponseWriter, r *http.Request)) h
 			ctx := context.WithValue(r.Context(), "username", inUsername)
 			ctx = context.WithValue(ctx, "password", inPw)
 			delegate(w, r.WithContext(ctx))
+			if status, ok := responseStatus(w); !ok || (status != http.StatusUnauthorized && status != http.StatusForbidden) {
+				setRequestUser(r, inUsername)
+			}
 		}
 	}
 }
@@ -0,0 +1,71 @@
+package web_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+)
+
+type codedError struct {
+	Code int `json:"code"`
+}
+
+func TestCatchFatal(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/friendly", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(web.HeaderContentType, "text/html")
+		panic(util.FriendlyErrorMessage{ErrorMessage: "Not today"})
+	}))
+	mux.HandleFunc("/struct", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		panic(codedError{Code: 7})
+	}))
+	mux.HandleFunc("/text", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		panic("broken")
+	}))
+	mux.HandleFunc("/committed", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		util.Write(w, []byte(`{"items":[`))
+		http.NewResponseController(w).Flush()
+		if !web.ResponseCommitted(w) {
+			t.Error("Response not committed")
+		}
+		panic("broken halfway")
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cases := []struct {
+		path        string
+		contentType string
+		errorHeader string
+		body        string
+	}{
+		{"/friendly", web.ContentTypeApplicationJson, "true", `{"errorMessage":"Not today"}`},
+		{"/struct", web.ContentTypeApplicationJson, "", `{"code":7}`},
+		{"/text", "text/plain; charset=utf-8", "", "broken"},
+	}
+	for _, c := range cases {
+		response, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusInternalServerError || response.Header.Get(web.HeaderContentType) != c.contentType ||
+			response.Header.Get(web.ErrorHeaderName) != c.errorHeader || string(body) != c.body {
+			t.Fatalf("Unexpected response for %s: %d %v %q", c.path, response.StatusCode, response.Header, body)
+		}
+	}
+
+	response, err := http.Get(server.URL + "/committed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || err == nil || string(body) != `{"items":[` {
+		t.Fatalf("Committed response not aborted: %d %v %q", response.StatusCode, err, body)
+	}
+}
@@ -0,0 +1,212 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// ParseNetworks accepts CIDRs and single addresses, panics on anything else
+func ParseNetworks(networks []string) []netip.Prefix {
+	result := make([]netip.Prefix, len(networks))
+	for i, network := range networks {
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			result[i] = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(network); err == nil {
+			addr = addr.Unmap()
+			result[i] = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			panic(fmt.Sprintf("Invalid network %s", network))
+		}
+	}
+	return result
+}
+
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxyConfig Header is the one the proxies set, the other one is ignored since clients could send it
+// through the proxies untouched
+type TrustedProxyConfig struct {
+	Proxies []string `json:"proxies"`
+	Header  *string  `json:"header"`
+}
+
+func DefaultTrustedProxyConfig(proxies ...string) TrustedProxyConfig {
+	return TrustedProxyConfig{Proxies: proxies, Header: util.PStr(HeaderXForwardedFor)}
+}
+
+func (o *TrustedProxyConfig) Validate() {
+	if len(o.Proxies) == 0 {
+		panic("Invalid proxies")
+	}
+	ParseNetworks(o.Proxies)
+	if o.Header == nil || (*o.Header != HeaderXForwardedFor && *o.Header != HeaderForwarded) {
+		panic("Invalid header")
+	}
+}
+
+type trustedProxyResolver struct {
+	proxies []netip.Prefix
+	header  string
+}
+
+var trustedProxies *trustedProxyResolver
+
+// ConfigureTrustedProxies makes ResolveClientIP, and so the logs, rate limits and IP filters, use the forwarded
+// client address of requests coming from the proxies
+func ConfigureTrustedProxies(config TrustedProxyConfig) {
+	config.Validate()
+	trustedProxies = &trustedProxyResolver{proxies: ParseNetworks(config.Proxies), header: *config.Header}
+}
+
+// ResetTrustedProxies back to using the peer address of every request
+func ResetTrustedProxies() {
+	trustedProxies = nil
+}
+
+// forwardedFor the hops in the order they were appended, the client first
+func (o *trustedProxyResolver) forwardedFor(r *http.Request) []string {
+	result := make([]string, 0)
+	for _, value := range r.Header.Values(o.header) {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if o.header == HeaderForwarded {
+				element = forwardedParam(element, "for")
+			}
+			if element != "" {
+				result = append(result, element)
+			}
+		}
+	}
+	return result
+}
+
+// forwardedParam the value of name in one RFC 7239 element, i.e. for="[2001:db8::1]:4711";proto=https
+func forwardedParam(element string, name string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseHop accepts addresses with port and bracketed IPv6 as found in Forwarded
+func parseHop(hop string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	return addr.Unmap(), err == nil
+}
+
+// resolve walks the hops from the closest one and returns the first one not being a trusted proxy, so
+// addresses prepended by the client are never used. It stops at hops that are not addresses, i.e. "unknown".
+func (o *trustedProxyResolver) resolve(r *http.Request, peer netip.Addr) netip.Addr {
+	if !containsAddr(o.proxies, peer) {
+		return peer
+	}
+	hops := o.forwardedFor(r)
+	result := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		result = addr
+		if !containsAddr(o.proxies, addr) {
+			break
+		}
+	}
+	return result
+}
+
+func resolveClientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	peer = peer.Unmap()
+	if trustedProxies != nil {
+		return trustedProxies.resolve(r, peer), true
+	}
+	return peer, true
+}
+
+// IPFilterConfig a request is denied when its client address is in Deny, or Allow is not empty and the
+// address is not in it. Entries are CIDRs or single addresses.
+type IPFilterConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func (o *IPFilterConfig) Validate() {
+	if len(o.Allow) == 0 && len(o.Deny) == 0 {
+		panic("Invalid allow and deny")
+	}
+	ParseNetworks(o.Allow)
+	ParseNetworks(o.Deny)
+}
+
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Allowed requests without a parsable client address are only allowed when there is no allow list
+func (o *IPFilter) Allowed(r *http.Request) bool {
+	addr, ok := resolveClientAddr(r)
+	if !ok {
+		return len(o.allow) == 0
+	}
+	if containsAddr(o.deny, addr) {
+		return false
+	}
+	return len(o.allow) == 0 || containsAddr(o.allow, addr)
+}
+
+func NewIPFilter(config IPFilterConfig) *IPFilter {
+	config.Validate()
+	return &IPFilter{allow: ParseNetworks(config.Allow), deny: ParseNetworks(config.Deny)}
+}
+
+// InterceptIPFilter answers 403 through InterceptFatal to the requests the filter denies, a nil filter allows everything
+func InterceptIPFilter(filter *IPFilter, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if filter == nil || filter.Allowed(r) {
+			delegate(w, r)
+			return
+		}
+		stats.PushDenied(routeKey(r))
+		ThrowHttpError(http.StatusForbidden, "Access denied to %s", ResolveClientIP(r))
+	}
+}
+
+func InterceptAllowIPs(networks []string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return InterceptIPFilter(NewIPFilter(IPFilterConfig{Allow: networks}), delegate)
+}
+
+func InterceptDenyIPs(networks []string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return InterceptIPFilter(NewIPFilter(IPFilterConfig{Deny: networks}), delegate)
+}
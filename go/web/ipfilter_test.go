@@ -0,0 +1,84 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+)
+
+func routeDeniedCount(t *testing.T, route string) float64 {
+	recorder := httptest.NewRecorder()
+	web.StatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	snapshot := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshot {
+		if s["path"].(string) == route {
+			return s["accumCounters"].(map[string]interface{})["deniedCount"].(float64)
+		}
+	}
+	return 0
+}
+
+func TestIPFilter(t *testing.T) {
+	// only requests from 10.0.0.0/8 are affected so tests running on loopback keep their addresses
+	web.ConfigureTrustedProxies(web.DefaultTrustedProxyConfig("10.0.0.0/8"))
+	t.Cleanup(web.ResetTrustedProxies)
+	newRequest := func(remoteAddr string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ipfilter", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+	cases := []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"203.0.113.7:1234", map[string]string{web.HeaderXForwardedFor: "198.51.100.1"}, "203.0.113.7"},
+		{"10.0.0.1:1234", map[string]string{web.HeaderXForwardedFor: "192.0.2.1, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"10.0.0.1:1234", map[string]string{web.HeaderXForwardedFor: "10.0.0.3"}, "10.0.0.3"},
+		{"10.0.0.1:1234", map[string]string{web.HeaderForwarded: "for=198.51.100.9"}, "10.0.0.1"},
+		{"[::ffff:10.0.0.1]:1234", map[string]string{web.HeaderXForwardedFor: "[2001:db8::1]:4711"}, "2001:db8::1"},
+	}
+	for _, c := range cases {
+		if ip := web.ResolveClientIP(newRequest(c.remoteAddr, c.headers)); ip != c.expected {
+			t.Fatalf("Unexpected client ip %s for %s %v, expected %s", ip, c.remoteAddr, c.headers, c.expected)
+		}
+	}
+
+	baseline := routeDeniedCount(t, "/ipfilter")
+	handler := web.InterceptFatal(web.InterceptIPFilter(web.NewIPFilter(web.IPFilterConfig{
+		Allow: []string{"198.51.100.0/24", "2001:db8::/32"},
+		Deny:  []string{"198.51.100.66"},
+	}), func(w http.ResponseWriter, r *http.Request) {
+		util.Write(w, []byte("ok"))
+	}))
+	statuses := []struct {
+		remoteAddr string
+		headers    map[string]string
+		status     int
+	}{
+		{"10.0.0.1:1234", map[string]string{web.HeaderXForwardedFor: "198.51.100.9"}, http.StatusOK},
+		{"10.0.0.1:1234", map[string]string{web.HeaderXForwardedFor: "198.51.100.66"}, http.StatusForbidden},
+		{"10.0.0.1:1234", map[string]string{web.HeaderXForwardedFor: "198.51.100.9, 192.0.2.1"}, http.StatusForbidden},
+		{"[2001:db8::5]:1234", nil, http.StatusOK},
+		{"198.51.100.9:1234", nil, http.StatusOK},
+	}
+	for _, c := range statuses {
+		recorder := httptest.NewRecorder()
+		handler(recorder, newRequest(c.remoteAddr, c.headers))
+		if recorder.Code != c.status {
+			t.Fatalf("Unexpected status %d for %s %v, expected %d", recorder.Code, c.remoteAddr, c.headers, c.status)
+		}
+	}
+	if denied := routeDeniedCount(t, "/ipfilter") - baseline; denied != 2 {
+		t.Fatalf("Unexpected denied count %v", denied)
+	}
+}
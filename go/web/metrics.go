@@ -0,0 +1,309 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/util"
+)
+
+const ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	route  string
+	method string
+}
+
+type requestStatusKey struct {
+	requestKey
+	status int
+}
+
+type metricHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (o *metricHistogram) observe(buckets []float64, v float64) {
+	for i, b := range buckets {
+		if v <= b {
+			o.counts[i]++
+		}
+	}
+	o.count++
+	o.sum += v
+}
+
+type webMetrics struct {
+	mux      *sync.Mutex
+	buckets  []float64
+	requests map[requestStatusKey]int64
+	latency  map[requestKey]*metricHistogram
+	inFlight map[requestKey]int64
+	sockets  map[string]int64
+}
+
+func (o *webMetrics) PushIn(route string, method string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.inFlight[requestKey{route: route, method: method}]++
+}
+
+func (o *webMetrics) PushOut(route string, method string, status int, duration time.Duration) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	key := requestKey{route: route, method: method}
+	o.inFlight[key]--
+	o.requests[requestStatusKey{requestKey: key, status: status}]++
+	h, ok := o.latency[key]
+	if !ok {
+		h = &metricHistogram{counts: make([]int64, len(o.buckets))}
+		o.latency[key] = h
+	}
+	h.observe(o.buckets, duration.Seconds())
+}
+
+// PushStreamOut streams are counted but kept out of the latency histogram
+func (o *webMetrics) PushStreamOut(route string, method string, status int) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	key := requestKey{route: route, method: method}
+	o.inFlight[key]--
+	o.requests[requestStatusKey{requestKey: key, status: status}]++
+}
+
+func (o *webMetrics) PushWebSocket(route string, delta int64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.sockets[route] += delta
+}
+
+func (o *webMetrics) write(buffer *bytes.Buffer) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	buffer.WriteString("# HELP http_requests_total Requests served by route, method and status code.\n")
+	buffer.WriteString("# TYPE http_requests_total counter\n")
+	requestKeys := make([]requestStatusKey, 0, len(o.requests))
+	for k := range o.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].requestKey != requestKeys[j].requestKey {
+			return lessRequestKey(requestKeys[i].requestKey, requestKeys[j].requestKey)
+		}
+		return requestKeys[i].status < requestKeys[j].status
+	})
+	for _, k := range requestKeys {
+		writeMetric(buffer, "http_requests_total", o.requests[k], "route", k.route, "method", k.method, "code", strconv.Itoa(k.status))
+	}
+
+	buffer.WriteString("# HELP http_request_duration_seconds Request latency by route and method.\n")
+	buffer.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, k := range sortedRequestKeys(o.latency) {
+		h := o.latency[k]
+		for i, b := range o.buckets {
+			writeMetric(buffer, "http_request_duration_seconds_bucket", h.counts[i], "route", k.route, "method", k.method, "le", formatFloat(b))
+		}
+		writeMetric(buffer, "http_request_duration_seconds_bucket", h.count, "route", k.route, "method", k.method, "le", "+Inf")
+		writeMetric(buffer, "http_request_duration_seconds_sum", h.sum, "route", k.route, "method", k.method)
+		writeMetric(buffer, "http_request_duration_seconds_count", h.count, "route", k.route, "method", k.method)
+	}
+
+	buffer.WriteString("# HELP http_requests_in_flight Requests being served by route and method.\n")
+	buffer.WriteString("# TYPE http_requests_in_flight gauge\n")
+	for _, k := range sortedRequestKeys(o.inFlight) {
+		writeMetric(buffer, "http_requests_in_flight", o.inFlight[k], "route", k.route, "method", k.method)
+	}
+
+	writeHeader(buffer, "websocket_connections", "Open websocket connections by route.", "gauge")
+	routes := make([]string, 0, len(o.sockets))
+	for k := range o.sockets {
+		routes = append(routes, k)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		writeMetric(buffer, "websocket_connections", o.sockets[route], "route", route)
+	}
+}
+
+func lessRequestKey(a requestKey, b requestKey) bool {
+	if a.route != b.route {
+		return a.route < b.route
+	}
+	return a.method < b.method
+}
+
+func sortedRequestKeys[T any](m map[requestKey]T) []requestKey {
+	keys := make([]requestKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessRequestKey(keys[i], keys[j])
+	})
+	return keys
+}
+
+func writeDatabaseMetrics(buffer *bytes.Buffer) {
+	dbStats := sql.GlobalDatabases.Stats()
+	names := make([]string, 0, len(dbStats))
+	for k := range dbStats {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	gauges := []struct {
+		name  string
+		help  string
+		value func(name string) any
+	}{
+		{"db_pool_max_open_connections", "Maximum number of open connections.", func(n string) any { return dbStats[n].MaxOpenConnections }},
+		{"db_pool_open_connections", "Established connections, in use and idle.", func(n string) any { return dbStats[n].OpenConnections }},
+		{"db_pool_in_use_connections", "Connections currently in use.", func(n string) any { return dbStats[n].InUse }},
+		{"db_pool_idle_connections", "Idle connections.", func(n string) any { return dbStats[n].Idle }},
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(name string) any
+	}{
+		{"db_pool_wait_count_total", "Connections waited for.", func(n string) any { return dbStats[n].WaitCount }},
+		{"db_pool_wait_duration_seconds_total", "Time blocked waiting for a connection.", func(n string) any { return dbStats[n].WaitDuration.Seconds() }},
+		{"db_pool_max_idle_closed_total", "Connections closed due to SetMaxIdleConns.", func(n string) any { return dbStats[n].MaxIdleClosed }},
+		{"db_pool_max_lifetime_closed_total", "Connections closed due to SetConnMaxLifetime.", func(n string) any { return dbStats[n].MaxLifetimeClosed }},
+	}
+	for _, g := range gauges {
+		writeHeader(buffer, g.name, g.help, "gauge")
+		for _, n := range names {
+			writeMetric(buffer, g.name, g.value(n), "datasource", n)
+		}
+	}
+	for _, c := range counters {
+		writeHeader(buffer, c.name, c.help, "counter")
+		for _, n := range names {
+			writeMetric(buffer, c.name, c.value(n), "datasource", n)
+		}
+	}
+}
+
+func writeBreakerMetrics(buffer *bytes.Buffer) {
+	snapshot := BreakerStats()
+	writeHeader(buffer, "circuit_breaker_state", "Breaker state: 0 closed, 1 open, 2 half-open.", "gauge")
+	for _, b := range snapshot {
+		writeMetric(buffer, "circuit_breaker_state", int(b.State), "name", b.Name)
+	}
+	writeHeader(buffer, "circuit_breaker_requests_total", "Calls let through the breaker.", "counter")
+	for _, b := range snapshot {
+		writeMetric(buffer, "circuit_breaker_requests_total", b.TotalRequests, "name", b.Name)
+	}
+	writeHeader(buffer, "circuit_breaker_failures_total", "Calls let through the breaker that failed.", "counter")
+	for _, b := range snapshot {
+		writeMetric(buffer, "circuit_breaker_failures_total", b.TotalFailures, "name", b.Name)
+	}
+	writeHeader(buffer, "circuit_breaker_rejected_total", "Calls rejected by the breaker.", "counter")
+	for _, b := range snapshot {
+		writeMetric(buffer, "circuit_breaker_rejected_total", b.TotalRejected, "name", b.Name)
+	}
+}
+
+func writeRuntimeMetrics(buffer *bytes.Buffer) {
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	writeHeader(buffer, "go_goroutines", "Number of goroutines that currently exist.", "gauge")
+	writeMetric(buffer, "go_goroutines", runtime.NumGoroutine())
+	writeHeader(buffer, "go_memstats_alloc_bytes", "Bytes allocated and still in use.", "gauge")
+	writeMetric(buffer, "go_memstats_alloc_bytes", memStats.Alloc)
+	writeHeader(buffer, "go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", "gauge")
+	writeMetric(buffer, "go_memstats_heap_inuse_bytes", memStats.HeapInuse)
+	writeHeader(buffer, "go_memstats_heap_objects", "Number of allocated heap objects.", "gauge")
+	writeMetric(buffer, "go_memstats_heap_objects", memStats.HeapObjects)
+	writeHeader(buffer, "go_memstats_sys_bytes", "Bytes obtained from the OS.", "gauge")
+	writeMetric(buffer, "go_memstats_sys_bytes", memStats.Sys)
+	writeHeader(buffer, "go_memstats_alloc_bytes_total", "Bytes allocated, even if freed.", "counter")
+	writeMetric(buffer, "go_memstats_alloc_bytes_total", memStats.TotalAlloc)
+	writeHeader(buffer, "go_gc_cycles_total", "Completed GC cycles.", "counter")
+	writeMetric(buffer, "go_gc_cycles_total", memStats.NumGC)
+	writeHeader(buffer, "go_gc_pause_seconds_total", "Cumulative GC stop-the-world pause time.", "counter")
+	writeMetric(buffer, "go_gc_pause_seconds_total", float64(memStats.PauseTotalNs)/float64(time.Second))
+	writeHeader(buffer, "process_start_time_seconds", "Start time of the process since unix epoch in seconds.", "gauge")
+	writeMetric(buffer, "process_start_time_seconds", float64(util.GetStartTime().UnixNano())/float64(time.Second))
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, help string, metricType string) {
+	buffer.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType))
+}
+
+// writeMetric labels come as name/value pairs
+func writeMetric(buffer *bytes.Buffer, name string, value any, labels ...string) {
+	buffer.WriteString(name)
+	if len(labels) > 0 {
+		buffer.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteString(labels[i])
+			buffer.WriteString(`="`)
+			buffer.WriteString(escapeLabelValue(labels[i+1]))
+			buffer.WriteByte('"')
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte(' ')
+	switch v := value.(type) {
+	case float64:
+		buffer.WriteString(formatFloat(v))
+	default:
+		buffer.WriteString(fmt.Sprint(v))
+	}
+	buffer.WriteByte('\n')
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func newMetrics() *webMetrics {
+	return &webMetrics{
+		mux:      &sync.Mutex{},
+		buckets:  defaultLatencyBuckets,
+		requests: make(map[requestStatusKey]int64),
+		latency:  make(map[requestKey]*metricHistogram),
+		inFlight: make(map[requestKey]int64),
+		sockets:  make(map[string]int64),
+	}
+}
+
+var metrics = newMetrics()
+
+// MetricsHandler exposes web, database pool and runtime metrics in prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	buffer := &bytes.Buffer{}
+	metrics.write(buffer)
+	writeDatabaseMetrics(buffer)
+	writeBreakerMetrics(buffer)
+	writeRuntimeMetrics(buffer)
+	w.Header().Set(HeaderContentType, ContentTypePrometheus)
+	util.Write(w, buffer.Bytes())
+}
+
+func ConfigureMetricsHandler(serveMux *http.ServeMux, path string, secret string) {
+	ConfigureHandlerSecret(serveMux, path, secret, MetricsHandler)
+}
@@ -0,0 +1,134 @@
+package web_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	sampleRegexp = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? (\S+)$`)
+	labelsRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*")*$`)
+)
+
+// scrapeMetrics checks every sample has a valid name, labels and value and belongs to a family declared
+// before it, and returns the samples keyed by name and labels and the family types
+func scrapeMetrics(t *testing.T, url string) (map[string]float64, map[string]string) {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get(web.HeaderContentType); contentType != web.ContentTypePrometheus {
+		t.Fatalf("Unexpected content type %s", contentType)
+	}
+	b, _ := io.ReadAll(response.Body)
+	types := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			if _, ok := types[fields[2]]; ok {
+				t.Fatalf("Family %s declared twice", fields[2])
+			}
+			types[fields[2]] = fields[3]
+			continue
+		}
+		match := sampleRegexp.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("Invalid line %q", line)
+		}
+		if match[2] != "" && !labelsRegexp.MatchString(match[2]) {
+			t.Fatalf("Invalid labels in %q", line)
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Fatalf("Invalid value in %q", line)
+		}
+		family := match[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base, ok := strings.CutSuffix(family, suffix); ok && types[base] == "histogram" {
+				family = base
+			}
+		}
+		if types[family] == "" {
+			t.Fatalf("Sample %q without a type", line)
+		}
+		samples[match[1]+"{"+match[2]+"}"] = value
+	}
+	return samples, types
+}
+
+func TestMetrics(t *testing.T) {
+	web.ResolveBreaker("quote\"back\\slash\nline", web.DefaultBreakerConfig())
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics-test/{id}", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "missing" {
+			web.ThrowHttpError(http.StatusNotFound, "Not found")
+		}
+		util.Write(w, []byte("ok"))
+	}))
+	mux.HandleFunc("/metrics", web.MetricsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// metrics are global, counters are checked as increments
+	before, _ := scrapeMetrics(t, server.URL+"/metrics")
+	for _, id := range []string{"1", "2", "missing"} {
+		response, err := http.Get(server.URL + "/metrics-test/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	samples, types := scrapeMetrics(t, server.URL+"/metrics")
+
+	labels := `route="GET /metrics-test/{id}",method="GET"`
+	increments := map[string]float64{
+		`http_requests_total{` + labels + `,code="200"}`:                 2,
+		`http_requests_total{` + labels + `,code="404"}`:                 1,
+		`http_request_duration_seconds_bucket{` + labels + `,le="+Inf"}`: 3,
+		`http_request_duration_seconds_count{` + labels + `}`:            3,
+	}
+	for k, v := range increments {
+		if samples[k]-before[k] != v {
+			t.Fatalf("Unexpected %s %v, %v before", k, samples[k], before[k])
+		}
+	}
+	values := map[string]float64{
+		`http_requests_in_flight{` + labels + `}`:                0,
+		`circuit_breaker_state{name="quote\"back\\slash\nline"}`: 0,
+	}
+	for k, v := range values {
+		if value, ok := samples[k]; !ok || value != v {
+			t.Fatalf("Unexpected %s %v", k, value)
+		}
+	}
+	for family, metricType := range map[string]string{"http_requests_total": "counter", "http_request_duration_seconds": "histogram",
+		"http_requests_in_flight": "gauge", "go_goroutines": "gauge", "db_pool_open_connections": "gauge"} {
+		if types[family] != metricType {
+			t.Fatalf("Unexpected type %q of %s", types[family], family)
+		}
+	}
+
+	// buckets are cumulative
+	previous := 0.0
+	for _, le := range []string{"0.005", "0.01", "0.025", "0.05", "0.1", "0.25", "0.5", "1", "2.5", "5", "10", "+Inf"} {
+		count, ok := samples[`http_request_duration_seconds_bucket{`+labels+`,le="`+le+`"}`]
+		if !ok {
+			t.Fatalf("Bucket %s missing", le)
+		}
+		if count < previous {
+			t.Fatalf("Bucket %s count %v below the previous one %v", le, count, previous)
+		}
+		previous = count
+	}
+}
@@ -0,0 +1,274 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	HeaderAccept              = "Accept"
+	ContentTypeApplicationXml = "application/xml"
+	ContentTypeTextCsv        = "text/csv"
+	FormatQueryParam          = "format"
+	FormatJson                = "json"
+	FormatXml                 = "xml"
+	FormatCsv                 = "csv"
+)
+
+var formatContentTypes = map[string]string{
+	FormatJson: ContentTypeApplicationJson,
+	FormatXml:  ContentTypeApplicationXml + "; charset=utf-8",
+	FormatCsv:  ContentTypeTextCsv + "; charset=utf-8",
+}
+
+// NegotiateFormat json, xml or csv. The format query parameter wins over the Accept header, json when
+// nothing else is acceptable.
+func NegotiateFormat(r *http.Request) string {
+	format := strings.ToLower(r.URL.Query().Get(FormatQueryParam))
+	if _, ok := formatContentTypes[format]; ok {
+		return format
+	}
+	return negotiateAccept(r.Header.Get(HeaderAccept))
+}
+
+func negotiateAccept(accept string) string {
+	best := FormatJson
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		format := ""
+		switch {
+		case mediaType == ContentTypeApplicationJson || strings.HasSuffix(mediaType, "+json"):
+			format = FormatJson
+		case isXmlContentType(mediaType):
+			format = FormatXml
+		case mediaType == ContentTypeTextCsv:
+			format = FormatCsv
+		default:
+			continue
+		}
+		if q > bestQ {
+			best = format
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// NegotiatedResponse serializes i in the negotiated format. XML honors xml tags, slices are wrapped in
+// <items><item>. CSV requires a struct or a slice of structs, columns are named after the json tags.
+func NegotiatedResponse(i interface{}, w http.ResponseWriter, r *http.Request) {
+	w.Header().Add(HeaderVary, HeaderAccept)
+	format := NegotiateFormat(r)
+	switch format {
+	case FormatXml:
+		buffer := &bytes.Buffer{}
+		buffer.WriteString(xml.Header)
+		XmlEncode(i, buffer)
+		w.Header().Set(HeaderContentType, formatContentTypes[format])
+		util.Write(w, buffer.Bytes())
+	case FormatCsv:
+		buffer := &bytes.Buffer{}
+		CsvEncode(i, buffer)
+		w.Header().Set(HeaderContentType, formatContentTypes[format])
+		util.Write(w, buffer.Bytes())
+	default:
+		JsonResponse(i, w)
+	}
+}
+
+func XmlEncode(i interface{}, w io.Writer) {
+	encoder := xml.NewEncoder(w)
+	v := reflect.Indirect(reflect.ValueOf(i))
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		items := xml.StartElement{Name: xml.Name{Local: "items"}}
+		util.CheckErr(encoder.EncodeToken(items))
+		for n := 0; n < v.Len(); n++ {
+			util.CheckErr(encoder.EncodeElement(v.Index(n).Interface(), xml.StartElement{Name: xml.Name{Local: "item"}}))
+		}
+		util.CheckErr(encoder.EncodeToken(items.End()))
+	} else {
+		util.CheckErr(encoder.Encode(i))
+	}
+	util.CheckErr(encoder.Flush())
+}
+
+type csvColumn struct {
+	name  string
+	index []int
+}
+
+func csvColumns(t reflect.Type, parent []int) []csvColumn {
+	result := make([]csvColumn, 0, t.NumField())
+	for n := 0; n < t.NumField(); n++ {
+		field := t.Field(n)
+		if !field.IsExported() {
+			continue
+		}
+		index := append(append([]int{}, parent...), n)
+		tag := field.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			result = append(result, csvColumns(fieldType, index)...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		result = append(result, csvColumn{name: name, index: index})
+	}
+	return result
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Type() == timeType:
+		return v.Interface().(time.Time).Format(time.RFC3339)
+	case v.Kind() == reflect.Struct || v.Kind() == reflect.Map || v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		return string(util.Marshal(v.Interface()))
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// fieldByIndex nil when an embedded pointer on the way is nil
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, n := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(n)
+	}
+	return v, true
+}
+
+func CsvEncode(i interface{}, w io.Writer) {
+	v := reflect.Indirect(reflect.ValueOf(i))
+	rows := []reflect.Value{v}
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		rows = make([]reflect.Value, v.Len())
+		for n := range rows {
+			rows[n] = v.Index(n)
+		}
+	}
+	elemType := v.Type()
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() == reflect.Pointer {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("CSV requires structs, got %v", elemType))
+	}
+	columns := csvColumns(elemType, nil)
+	writer := csv.NewWriter(w)
+	record := make([]string, len(columns))
+	for n, c := range columns {
+		record[n] = c.name
+	}
+	util.CheckErr(writer.Write(record))
+	for _, row := range rows {
+		row = reflect.Indirect(row)
+		if !row.IsValid() {
+			continue
+		}
+		for n, c := range columns {
+			if f, ok := fieldByIndex(row, c.index); ok {
+				record[n] = csvValue(f)
+			} else {
+				record[n] = ""
+			}
+		}
+		util.CheckErr(writer.Write(record))
+	}
+	writer.Flush()
+	util.CheckErr(writer.Error())
+}
+
+func isXmlContentType(mediaType string) bool {
+	return mediaType == ContentTypeApplicationXml || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+func decodeXml(reader io.Reader, o interface{}, config DecodeConfig) {
+	decoder := xml.NewDecoder(reader)
+	if err := decoder.Decode(o); err != nil {
+		checkXmlDecodeErr(err)
+	}
+	if *config.RejectTrailingData {
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				return
+			}
+			checkXmlDecodeErr(err)
+			switch t := token.(type) {
+			case xml.CharData:
+				if len(bytes.TrimSpace(t)) == 0 {
+					continue
+				}
+			case xml.Comment, xml.ProcInst:
+				continue
+			}
+			ThrowHttpError(http.StatusBadRequest, "Unexpected data after the request body")
+		}
+	}
+}
+
+func checkXmlDecodeErr(err error) {
+	if err == nil {
+		return
+	}
+	var syntaxError *xml.SyntaxError
+	var unmarshalError xml.UnmarshalError
+	var numError *strconv.NumError
+	switch {
+	case errors.As(err, &syntaxError):
+		ThrowHttpError(http.StatusBadRequest, "Malformed request body at line %d", syntaxError.Line)
+	case errors.As(err, &unmarshalError):
+		ThrowHttpError(http.StatusBadRequest, "Invalid request body: %s", string(unmarshalError))
+	case errors.As(err, &numError):
+		ThrowHttpError(http.StatusBadRequest, "Invalid value %q", numError.Num)
+	}
+	checkDecodeErr(err)
+}
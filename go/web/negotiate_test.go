@@ -0,0 +1,48 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+type negotiatedItem struct {
+	Id   *int64  `json:"id" xml:"id"`
+	Name *string `json:"name" xml:"name"`
+}
+
+func TestNegotiatedResponse(t *testing.T) {
+	items := []negotiatedItem{{Id: util.PInt64(1), Name: util.PStr("a,b")}, {Id: util.PInt64(2)}}
+	cases := []struct {
+		url      string
+		accept   string
+		expected string
+	}{
+		{"/items", "", `[{"id":1,"name":"a,b"},{"id":2,"name":null}]` + "\n"},
+		{"/items", "text/csv, application/json;q=0.5", "id,name\n1,\"a,b\"\n2,\n"},
+		{"/items?format=xml", web.ContentTypeApplicationJson, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+			`<items><item><id>1</id><name>a,b</name></item><item><id>2</id></item></items>`},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, c.url, nil)
+		request.Header.Set(web.HeaderAccept, c.accept)
+		recorder := httptest.NewRecorder()
+		web.NegotiatedResponse(items, recorder, request)
+		if recorder.Body.String() != c.expected {
+			t.Fatalf("%s %s: unexpected body %q", c.url, c.accept, recorder.Body.String())
+		}
+	}
+}
+
+func TestParseXmlBody(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`<item><id>3</id><name>c</name></item>`))
+	request.Header.Set(web.HeaderContentType, "text/xml; charset=utf-8")
+	item := negotiatedItem{}
+	web.ParseParamOrBody(request, &item)
+	if *item.Id != 3 || *item.Name != "c" {
+		t.Fatalf("Unexpected item %v", item)
+	}
+}
@@ -0,0 +1,283 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+type OpenApiInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+var securitySchemes = map[string]map[string]interface{}{
+	SecurityBearer: {
+		"type":        "http",
+		"scheme":      "bearer",
+		"description": "Session token, also accepted in the Toolkit-Authorization header or the toolkitToken query parameter",
+	},
+	SecuritySigned: {
+		"type": "apiKey",
+		"in":   "header",
+		"name": SignatureHeaderName,
+		"description": "HMAC signature, version " + SignatureVersion2 + " signs " + ClientIdHeaderName + ", " + TimestampHeaderName + ", " +
+			NonceHeaderName + ", the method, path, query and the body sha256 sent in " + ContentSha256HeaderName,
+	},
+	SecurityBasic: {
+		"type":   "http",
+		"scheme": "basic",
+	},
+	SecuritySecret: {
+		"type":        "apiKey",
+		"in":          "header",
+		"name":        "secret",
+		"description": "Also accepted as the secret cookie or query parameter",
+	},
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	wildcardRegexp = regexp.MustCompile(`\{([^}]*)\}`)
+	schemaNameRe   = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// openApiBuilder collects the named struct schemas under components
+type openApiBuilder struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+func (o *openApiBuilder) schemaName(t reflect.Type) string {
+	if name, ok := o.names[t]; ok {
+		return name
+	}
+	name := schemaNameRe.ReplaceAllString(t.Name(), "_")
+	if name == "" {
+		name = "Anonymous"
+	}
+	base := name
+	for n := 2; ; n++ {
+		if _, taken := o.schemas[name]; !taken {
+			break
+		}
+		name = base + strconv.Itoa(n)
+	}
+	o.names[t] = name
+	return name
+}
+
+func (o *openApiBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": o.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": o.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return o.structSchema(t)
+		}
+		_, known := o.names[t]
+		name := o.schemaName(t)
+		if !known {
+			// registered before building so recursive types end in a $ref
+			o.schemas[name] = map[string]interface{}{}
+			o.schemas[name] = o.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema properties named after the json tags, require:"true" fields are required and help tags
+// become descriptions
+func (o *openApiBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	o.collectFields(t, properties, &required)
+	result := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+func (o *openApiBuilder) collectFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			o.collectFields(fieldType, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := o.schema(field.Type)
+		if help := field.Tag.Get("help"); help != "" {
+			if _, isRef := property["$ref"]; isRef {
+				property = map[string]interface{}{"allOf": []interface{}{property}, "description": help}
+			} else {
+				property["description"] = help
+			}
+		}
+		properties[name] = property
+		if field.Tag.Get("require") == "true" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func contentOf(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		ContentTypeApplicationJson: map[string]interface{}{"schema": schema},
+	}
+}
+
+// openApiPath Go wildcards as OpenAPI parameters: {path...} becomes {path} and {$} is dropped
+func openApiPath(path string) (string, []string) {
+	names := make([]string, 0)
+	result := wildcardRegexp.ReplaceAllStringFunc(path, func(s string) string {
+		name := strings.TrimSuffix(s[1:len(s)-1], "...")
+		if name == "$" {
+			return ""
+		}
+		names = append(names, name)
+		return "{" + name + "}"
+	})
+	return result, names
+}
+
+func (o *openApiBuilder) operation(route *Route) map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": strings.ToLower(route.Method) + schemaNameRe.ReplaceAllString(route.Path, "_"),
+	}
+	if route.Summary != "" {
+		operation["summary"] = route.Summary
+	}
+	if route.Description != "" {
+		operation["description"] = route.Description
+	}
+	if len(route.Tags) > 0 {
+		operation["tags"] = route.Tags
+	}
+	_, names := openApiPath(route.Path)
+	if len(names) > 0 {
+		parameters := make([]interface{}, len(names))
+		for i, name := range names {
+			parameters[i] = map[string]interface{}{"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}}
+		}
+		operation["parameters"] = parameters
+	}
+	if route.Request != nil {
+		operation["requestBody"] = map[string]interface{}{"required": true, "content": contentOf(o.schema(route.Request))}
+	}
+	responses := map[string]interface{}{}
+	for status, t := range route.Responses {
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		if t != nil {
+			response["content"] = contentOf(o.schema(t))
+		}
+		responses[strconv.Itoa(status)] = response
+	}
+	if len(responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": http.StatusText(http.StatusOK)}
+	}
+	responses["default"] = map[string]interface{}{
+		"description": "Error, flagged by the " + ErrorHeaderName + " header",
+		"content":     contentOf(o.schema(reflect.TypeOf(util.FriendlyErrorMessage{}))),
+	}
+	operation["responses"] = responses
+	if route.Security != SecurityNone {
+		operation["security"] = []interface{}{map[string]interface{}{route.Security: []string{}}}
+	}
+	return operation
+}
+
+// OpenApiDocument an OpenAPI 3 document of the routes registered through router
+func OpenApiDocument(router *Router, info OpenApiInfo) map[string]interface{} {
+	builder := &openApiBuilder{schemas: make(map[string]interface{}), names: make(map[reflect.Type]string)}
+	paths := make(map[string]interface{})
+	usedSchemes := make(map[string]interface{})
+	for _, route := range router.Routes() {
+		if route.Hidden || route.Method == http.MethodOptions {
+			continue
+		}
+		path, _ := openApiPath(route.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = builder.operation(route)
+		if route.Security != SecurityNone {
+			usedSchemes[route.Security] = securitySchemes[route.Security]
+		}
+	}
+	components := map[string]interface{}{"schemas": builder.schemas}
+	if len(usedSchemes) > 0 {
+		components["securitySchemes"] = usedSchemes
+	}
+	return map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       info,
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// ConfigureOpenApi serves the document at path, it is built on the first request so every route
+// registered by then is included
+func ConfigureOpenApi(router *Router, path string, info OpenApiInfo) {
+	var document []byte
+	once := &sync.Once{}
+	router.Get(path, func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			document = util.Marshal(OpenApiDocument(router, info))
+		})
+		w.Header().Set(HeaderContentType, ContentTypeApplicationJson)
+		util.Write(w, document)
+	}).Hide()
+}
@@ -0,0 +1,64 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+type openApiItem struct {
+	Name     *string        `json:"name" require:"true" help:"Display name"`
+	Quantity *int64         `json:"quantity"`
+	Parent   *openApiItem   `json:"parent"`
+	Children []*openApiItem `json:"children"`
+}
+
+func TestOpenApi(t *testing.T) {
+	router := web.NewRouter(http.NewServeMux())
+	web.HandleTyped(router, http.MethodPut, "/openapi/items/{id}", func(r *http.Request, in *openApiItem) openApiItem {
+		in.Quantity = util.PInt64(web.PathParamInt64(r, "id"))
+		return *in
+	}).Describe("Update an item", "").Tag("items")
+	web.ConfigureOpenApi(router, "/openapi.json", web.OpenApiInfo{Title: "Test", Version: "1"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeMux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/openapi/items/3", strings.NewReader(`{"quantity":1}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Missing required field answered with %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeMux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	document := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) interface{} {
+		var current interface{} = document
+		for _, step := range strings.Split(path, "|") {
+			current = current.(map[string]interface{})[step]
+		}
+		return current
+	}
+	operation := get("paths|/openapi/items/{id}|put").(map[string]interface{})
+	if operation["summary"] != "Update an item" || len(operation["parameters"].([]interface{})) != 1 {
+		t.Fatalf("Unexpected operation %v", operation)
+	}
+	if get("paths|/openapi/items/{id}|put|requestBody|content|application/json|schema|$ref") != "#/components/schemas/openApiItem" {
+		t.Fatal("Request schema not referenced")
+	}
+	schema := get("components|schemas|openApiItem").(map[string]interface{})
+	if schema["required"].([]interface{})[0] != "name" || get("components|schemas|openApiItem|properties|name|description") != "Display name" {
+		t.Fatalf("Unexpected schema %v", schema)
+	}
+	if get("components|schemas|openApiItem|properties|children|items|$ref") != "#/components/schemas/openApiItem" {
+		t.Fatal("Recursive schema not referenced")
+	}
+	if _, ok := get("paths").(map[string]interface{})["/openapi.json"]; ok {
+		t.Fatal("Document path should be hidden")
+	}
+}
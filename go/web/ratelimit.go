@@ -0,0 +1,188 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/auth"
+)
+
+// RateLimitStore holds the token buckets. The in-memory implementation is enough for a single
+// instance, a shared implementation (redis, postgres...) is required when several instances
+// must enforce the same limits.
+type RateLimitStore interface {
+	// Take consumes one token from the bucket identified by key, creating it full when missing.
+	// When no token is available it returns false and the time until the next one.
+	Take(key string, rate float64, burst int) (bool, time.Duration)
+}
+
+type RateLimitConfig struct {
+	Rate  *float64 `json:"rate"`
+	Burst *int     `json:"burst"`
+}
+
+func (o *RateLimitConfig) Validate() {
+	if o.Rate == nil || *o.Rate <= 0 {
+		panic("Invalid rate")
+	}
+	if o.Burst == nil || *o.Burst <= 0 {
+		panic("Invalid burst")
+	}
+}
+
+type tokenBucket struct {
+	tokens     float64
+	rate       float64
+	burst      int
+	lastRefill time.Time
+}
+
+func (o *tokenBucket) refill(now time.Time) float64 {
+	elapsed := now.Sub(o.lastRefill).Seconds()
+	return math.Min(float64(o.burst), o.tokens+elapsed*o.rate)
+}
+
+type MemoryRateLimitStore struct {
+	mux          *sync.Mutex
+	buckets      map[string]*tokenBucket
+	lastShrink   time.Time
+	shrinkPeriod time.Duration
+}
+
+func (o *MemoryRateLimitStore) Take(key string, rate float64, burst int) (bool, time.Duration) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	now := time.Now()
+	if now.Sub(o.lastShrink) > o.shrinkPeriod {
+		o.shrink(now)
+	}
+	bucket, ok := o.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), rate: rate, burst: burst, lastRefill: now}
+		o.buckets[key] = bucket
+	} else {
+		bucket.rate = rate
+		bucket.burst = burst
+		bucket.tokens = bucket.refill(now)
+		bucket.lastRefill = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	missing := (1 - bucket.tokens) / rate
+	return false, time.Duration(missing * float64(time.Second))
+}
+
+// shrink drops the buckets that would be full by now, they are indistinguishable from new ones.
+func (o *MemoryRateLimitStore) shrink(now time.Time) {
+	for k, v := range o.buckets {
+		if v.refill(now) >= float64(v.burst) {
+			delete(o.buckets, k)
+		}
+	}
+	o.lastShrink = now
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		mux:          &sync.Mutex{},
+		buckets:      make(map[string]*tokenBucket),
+		lastShrink:   time.Now(),
+		shrinkPeriod: time.Minute,
+	}
+}
+
+type RateLimiter struct {
+	Name    string
+	Store   RateLimitStore
+	KeyFunc func(r *http.Request) string
+	Default RateLimitConfig
+	Routes  map[string]RateLimitConfig
+	mux     *sync.RWMutex
+}
+
+// SetRoute overrides the default limit for a route, the route being the registered pattern
+// (or the path when the handler was not registered through a mux)
+func (o *RateLimiter) SetRoute(route string, config RateLimitConfig) {
+	config.Validate()
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.Routes[route] = config
+}
+
+func (o *RateLimiter) resolveConfig(route string) RateLimitConfig {
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	if config, ok := o.Routes[route]; ok {
+		return config
+	}
+	return o.Default
+}
+
+// Allow consumes a token for the request, returning false and the suggested wait when rejected
+func (o *RateLimiter) Allow(r *http.Request) (bool, time.Duration) {
+	route := routeKey(r)
+	config := o.resolveConfig(route)
+	key := fmt.Sprintf("%s|%s|%s", o.Name, route, o.KeyFunc(r))
+	return o.Store.Take(key, *config.Rate, *config.Burst)
+}
+
+func NewRateLimiter(name string, keyFunc func(r *http.Request) string, config RateLimitConfig) *RateLimiter {
+	return NewRateLimiterWithStore(name, keyFunc, config, NewMemoryRateLimitStore())
+}
+
+func NewRateLimiterWithStore(name string, keyFunc func(r *http.Request) string, config RateLimitConfig, store RateLimitStore) *RateLimiter {
+	config.Validate()
+	return &RateLimiter{
+		Name:    name,
+		Store:   store,
+		KeyFunc: keyFunc,
+		Default: config,
+		Routes:  make(map[string]RateLimitConfig),
+		mux:     &sync.RWMutex{},
+	}
+}
+
+func RateLimitByIP(r *http.Request) string {
+	return "ip:" + ResolveClientIP(r)
+}
+
+// RateLimitByUser keys by the authenticated user, requires InterceptAuth to run first. Falls back to the client IP.
+func RateLimitByUser(r *http.Request) string {
+	sessionEntry := r.Context().Value("sessionEntry")
+	if sessionEntry != nil && sessionEntry.(*auth.SessionEntry).UserId != nil {
+		return fmt.Sprintf("user:%d", *sessionEntry.(*auth.SessionEntry).UserId)
+	}
+	return RateLimitByIP(r)
+}
+
+// RateLimitByClientId keys by the signed client id, requires InterceptSigned to run first. Falls back to the client IP.
+func RateLimitByClientId(r *http.Request) string {
+	clientId := r.Context().Value("clientId")
+	if clientId != nil && clientId.(string) != "" {
+		return "client:" + clientId.(string)
+	}
+	return RateLimitByIP(r)
+}
+
+func InterceptRateLimit(limiter *RateLimiter, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := limiter.Allow(r)
+		if !allowed {
+			stats.PushRejected(routeKey(r))
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set(HeaderRetryAfter, strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			delegate(w, r)
+		}
+	}
+}
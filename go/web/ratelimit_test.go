@@ -0,0 +1,45 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+)
+
+func TestInterceptRateLimit(t *testing.T) {
+	limiter := web.NewRateLimiter("test", web.RateLimitByIP, web.RateLimitConfig{Rate: util.PFloat64(0.001), Burst: util.PInt(2)})
+	limiter.SetRoute("/strict", web.RateLimitConfig{Rate: util.PFloat64(0.001), Burst: util.PInt(1)})
+	handler := web.InterceptRateLimit(limiter, func(w http.ResponseWriter, r *http.Request) {})
+
+	call := func(path string, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := call("/default", "10.0.0.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("Request %d rejected: %d", i, w.Code)
+		}
+	}
+	w := call("/default", "10.0.0.1:1001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if w.Header().Get(web.HeaderRetryAfter) == "" {
+		t.Fatal("Retry-After header missing")
+	}
+	if w := call("/default", "10.0.0.2:1000"); w.Code != http.StatusOK {
+		t.Fatalf("Other client rejected: %d", w.Code)
+	}
+	if w := call("/strict", "10.0.0.1:1000"); w.Code != http.StatusOK {
+		t.Fatalf("Route bucket shared with other routes: %d", w.Code)
+	}
+	if w := call("/strict", "10.0.0.1:1000"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Route limit not applied: %d", w.Code)
+	}
+}
@@ -0,0 +1,221 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/tx"
+)
+
+const (
+	SecurityNone   = ""
+	SecurityBearer = "bearer"
+	SecuritySigned = "signed"
+	SecurityBasic  = "basic"
+	SecuritySecret = "secret"
+)
+
+// Route a handler registered through a Router. Path may hold wildcards as in "/items/{id}".
+// The documentation fields feed the OpenAPI document.
+type Route struct {
+	Method      string
+	Path        string
+	Security    string
+	Summary     string
+	Description string
+	Tags        []string
+	Hidden      bool
+	Request     reflect.Type
+	Responses   map[int]reflect.Type
+}
+
+// Pattern the http.ServeMux pattern, also the key of the web stats and metrics
+func (o *Route) Pattern() string {
+	return o.Method + " " + o.Path
+}
+
+// Router registers handlers by method and path pattern on a ServeMux, the same interceptors as the
+// Configure* functions are applied. OPTIONS is answered for every registered path so CORS preflights work,
+// unless a handler is registered for it.
+type Router struct {
+	ServeMux *http.ServeMux
+	mux      *sync.Mutex
+	routes   []*Route
+	options  map[string]*optionsRoute
+}
+
+// optionsRoute the OPTIONS handler of a path, the automatic preflight answer is replaced when OPTIONS is
+// registered explicitly
+type optionsRoute struct {
+	handler  atomic.Pointer[http.HandlerFunc]
+	explicit bool
+}
+
+func (o *optionsRoute) serve(w http.ResponseWriter, r *http.Request) {
+	(*o.handler.Load())(w, r)
+}
+
+func (o *Router) resolveOptions(path string) *optionsRoute {
+	options, ok := o.options[path]
+	if !ok {
+		options = &optionsRoute{}
+		preflight := InterceptCORS(func(w http.ResponseWriter, r *http.Request) {})
+		options.handler.Store(&preflight)
+		o.ServeMux.HandleFunc(http.MethodOptions+" "+path, options.serve)
+		o.options[path] = options
+	}
+	return options
+}
+
+func (o *Router) register(method string, path string, security string, handler http.HandlerFunc) *Route {
+	method = strings.ToUpper(method)
+	route := &Route{Method: method, Path: path, Security: security}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if method == http.MethodOptions {
+		options := o.resolveOptions(path)
+		if options.explicit {
+			panic(fmt.Sprintf("Route %s already registered", route.Pattern()))
+		}
+		options.handler.Store(&handler)
+		options.explicit = true
+	} else {
+		o.ServeMux.HandleFunc(route.Pattern(), handler)
+		o.resolveOptions(path)
+	}
+	o.routes = append(o.routes, route)
+	return route
+}
+
+// routeCORS InterceptCORS answers OPTIONS by itself, explicit OPTIONS handlers get to answer the preflight
+func routeCORS(method string, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	if strings.ToUpper(method) != http.MethodOptions {
+		return InterceptCORS(delegate)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+		delegate(w, r)
+	}
+}
+
+// Routes in registration order
+func (o *Router) Routes() []*Route {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return append([]*Route{}, o.routes...)
+}
+
+func (o *Router) Handle(method string, path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecurityNone, InterceptFatal(routeCORS(method, f)))
+}
+
+func (o *Router) HandleTransactional(method string, path string, databaseConfig sql.DatasourceConfig, f func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecurityNone, InterceptFatal(routeCORS(method, tx.InterceptTransactional(databaseConfig, InterceptAudit(f)))))
+}
+
+func (o *Router) HandleAuthenticated(method string, path string, sessionManager *auth.SessionManager, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecurityBearer, InterceptFatal(routeCORS(method, InterceptAuth(sessionManager, f))))
+}
+
+func (o *Router) HandleAuthenticatedTransactional(method string, path string, sessionManager *auth.SessionManager, databaseConfig sql.DatasourceConfig, f func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecurityBearer, InterceptFatal(routeCORS(method, InterceptAuth(sessionManager, tx.InterceptTransactional(databaseConfig, InterceptAudit(f))))))
+}
+
+func (o *Router) HandleSigned(method string, path string, verifier *SignatureVerifier, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecuritySigned, InterceptFatal(routeCORS(method, InterceptSignedWith(verifier, f))))
+}
+
+func (o *Router) HandleBasicAuth(method string, path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecurityBasic, InterceptFatal(InterceptBasicAuth(routeCORS(method, f))))
+}
+
+func (o *Router) HandleSecret(method string, path string, secret string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.register(method, path, SecuritySecret, InterceptFatal(InterceptSecret(secret, routeCORS(method, f))))
+}
+
+func (o *Router) Get(path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.Handle(http.MethodGet, path, f)
+}
+
+func (o *Router) Post(path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.Handle(http.MethodPost, path, f)
+}
+
+func (o *Router) Put(path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.Handle(http.MethodPut, path, f)
+}
+
+func (o *Router) Patch(path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.Handle(http.MethodPatch, path, f)
+}
+
+func (o *Router) Delete(path string, f func(w http.ResponseWriter, r *http.Request)) *Route {
+	return o.Handle(http.MethodDelete, path, f)
+}
+
+func NewRouter(serveMux *http.ServeMux) *Router {
+	if serveMux == nil {
+		serveMux = http.DefaultServeMux
+	}
+	return &Router{ServeMux: serveMux, mux: &sync.Mutex{}, options: make(map[string]*optionsRoute)}
+}
+
+// PathParam the value of a {name} wildcard, a missing value is a 400
+func PathParam(r *http.Request, name string) string {
+	value := r.PathValue(name)
+	if value == "" {
+		ThrowHttpError(http.StatusBadRequest, "Missing path parameter %s", name)
+	}
+	return value
+}
+
+func PathParamInt64(r *http.Request, name string) int64 {
+	value, err := strconv.ParseInt(PathParam(r, name), 10, 64)
+	if err != nil {
+		ThrowHttpError(http.StatusBadRequest, "Invalid path parameter %s: %s", name, r.PathValue(name))
+	}
+	return value
+}
+
+func PathParamInt(r *http.Request, name string) int {
+	value, err := strconv.Atoi(PathParam(r, name))
+	if err != nil {
+		ThrowHttpError(http.StatusBadRequest, "Invalid path parameter %s: %s", name, r.PathValue(name))
+	}
+	return value
+}
+
+func PathParamFloat64(r *http.Request, name string) float64 {
+	value, err := strconv.ParseFloat(PathParam(r, name), 64)
+	if err != nil {
+		ThrowHttpError(http.StatusBadRequest, "Invalid path parameter %s: %s", name, r.PathValue(name))
+	}
+	return value
+}
+
+func PathParamBool(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(PathParam(r, name))
+	if err != nil {
+		ThrowHttpError(http.StatusBadRequest, "Invalid path parameter %s: %s", name, r.PathValue(name))
+	}
+	return value
+}
+
+// PathParamEnum the value must be one of allowed
+func PathParamEnum(r *http.Request, name string, allowed ...string) string {
+	value := PathParam(r, name)
+	for _, a := range allowed {
+		if a == value {
+			return value
+		}
+	}
+	ThrowHttpError(http.StatusBadRequest, "Invalid path parameter %s: %s, expected one of %s", name, value, fmt.Sprint(allowed))
+	return ""
+}
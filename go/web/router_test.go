@@ -0,0 +1,89 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+)
+
+func routeInCount(t *testing.T, route string) float64 {
+	recorder := httptest.NewRecorder()
+	web.StatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	snapshot := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshot {
+		path := s["path"].(string)
+		if path == route {
+			return s["accumCounters"].(map[string]interface{})["inCount"].(float64)
+		} else if strings.HasPrefix(path, "/router/") {
+			t.Fatalf("Stats keyed by url %s", path)
+		}
+	}
+	return 0
+}
+
+func TestRouter(t *testing.T) {
+	// stats are global, other runs may have counted the route already
+	baseline := routeInCount(t, "GET /router/items/{id}")
+	router := web.NewRouter(http.NewServeMux())
+	router.Get("/router/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		web.JsonResponse(map[string]int64{"id": web.PathParamInt64(r, "id")}, w)
+	})
+
+	serve := func(method string, url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeMux.ServeHTTP(recorder, httptest.NewRequest(method, url, nil))
+		return recorder
+	}
+	if recorder := serve(http.MethodGet, "/router/items/7"); recorder.Code != http.StatusOK || recorder.Body.String() != "{\"id\":7}\n" {
+		t.Fatalf("Unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	serve(http.MethodGet, "/router/items/8")
+	if recorder := serve(http.MethodGet, "/router/items/x"); recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid parameter answered with %d", recorder.Code)
+	}
+	if recorder := serve(http.MethodPost, "/router/items/7"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Wrong method answered with %d", recorder.Code)
+	}
+	if recorder := serve(http.MethodOptions, "/router/items/7"); recorder.Code != http.StatusOK || recorder.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Preflight answered with %d", recorder.Code)
+	}
+
+	if in := routeInCount(t, "GET /router/items/{id}") - baseline; in != 3 {
+		t.Fatalf("Route counted %v requests", in)
+	}
+}
+
+func TestRouterOptions(t *testing.T) {
+	router := web.NewRouter(http.NewServeMux())
+	explicit := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusNoContent)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	// explicit OPTIONS after and before the other methods of the path
+	router.Get("/after", ok)
+	router.Handle(http.MethodOptions, "/after", explicit)
+	router.Handle(http.MethodOptions, "/before", explicit)
+	router.Post("/before", ok)
+	router.Get("/auto", ok)
+
+	for path, status := range map[string]int{"/after": http.StatusNoContent, "/before": http.StatusNoContent, "/auto": http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		router.ServeMux.ServeHTTP(recorder, httptest.NewRequest(http.MethodOptions, path, nil))
+		if recorder.Code != status {
+			t.Fatalf("OPTIONS %s answered with %d, expected %d", path, recorder.Code, status)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Duplicated OPTIONS route accepted")
+		}
+	}()
+	router.Handle(http.MethodOptions, "/after", explicit)
+}
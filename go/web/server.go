@@ -0,0 +1,151 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/util"
+)
+
+type shutdownHook struct {
+	name string
+	f    func()
+}
+
+// Server wraps http.Server with an orderly shutdown: stop accepting requests, drain the in-flight
+// ones up to ShutdownTimeout, stop background tasks, run the hooks, close the databases and flush the logs
+type Server struct {
+	HttpServer      *http.Server
+	ShutdownTimeout time.Duration
+	hooks           []shutdownHook
+	sessionManagers []*auth.SessionManager
+	mux             *sync.Mutex
+	stopped         chan struct{}
+	shutdownOnce    *sync.Once
+}
+
+// AddShutdownHook hooks run in reverse registration order, after the http server is drained and
+// before databases are closed
+func (o *Server) AddShutdownHook(name string, f func()) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.hooks = append(o.hooks, shutdownHook{name: name, f: f})
+}
+
+// AddSessionManager the session maintenance gets stopped on shutdown
+func (o *Server) AddSessionManager(sessionManager *auth.SessionManager) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.sessionManagers = append(o.sessionManagers, sessionManager)
+}
+
+// Start serves in the background, a failure to listen (port in use, bad certificate) is logged and makes Run return
+func (o *Server) Start() {
+	go func() {
+		defer close(o.stopped)
+		defer func() {
+			if r := recover(); r != nil {
+				util.ProcessError(fmt.Sprintf("Http server failed: %v", r))
+			}
+		}()
+		if o.HttpServer.TLSConfig != nil {
+			util.Log("info").Println("Starting https server at " + o.HttpServer.Addr)
+			ListenTLS(o.HttpServer)
+		} else {
+			util.Log("info").Println("Starting http server at " + o.HttpServer.Addr)
+			Listen(o.HttpServer)
+		}
+	}()
+}
+
+// Run starts the server and blocks until SIGTERM or SIGINT is received and the shutdown is complete
+func (o *Server) Run() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	o.Start()
+	select {
+	case s := <-signals:
+		util.Log("info").Printf("Received %v, shutting down", s)
+	case <-o.stopped:
+		util.Log("info").Println("Http server stopped, shutting down")
+	}
+	o.Shutdown()
+}
+
+func (o *Server) Shutdown() {
+	o.shutdownOnce.Do(o.doShutdown)
+}
+
+func (o *Server) doShutdown() {
+	t0 := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), o.ShutdownTimeout)
+	defer cancel()
+	err := o.HttpServer.Shutdown(ctx)
+	if err != nil {
+		util.Log("warning").Printf("Http server did not drain in %v, closing remaining connections: %v", o.ShutdownTimeout, err)
+		util.ProcessError(o.HttpServer.Close())
+	}
+	StopWebStats()
+	o.mux.Lock()
+	sessionManagers := o.sessionManagers
+	hooks := o.hooks
+	o.mux.Unlock()
+	for _, sm := range sessionManagers {
+		sm.StopMaintenance()
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		runShutdownHook(hooks[i])
+	}
+	sql.GlobalDatabases.CloseAll()
+	util.Log("info").Printf("Shutdown completed in %v", time.Since(t0))
+	flushAccessLog()
+	util.FlushLoggers()
+}
+
+func runShutdownHook(hook shutdownHook) {
+	defer func() {
+		if r := recover(); r != nil {
+			util.ProcessError(fmt.Sprintf("Shutdown hook %s failed: %v", hook.name, r))
+		}
+	}()
+	util.Log("info").Printf("Running shutdown hook %s", hook.name)
+	hook.f()
+}
+
+// serverStopping closed when the Server serving the request starts shutting down, nil outside a Server
+func serverStopping(r *http.Request) <-chan struct{} {
+	stopping, _ := r.Context().Value("serverStopping").(chan struct{})
+	return stopping
+}
+
+func NewServer(serveMux *http.ServeMux, port int) *Server {
+	if serveMux == nil {
+		serveMux = http.DefaultServeMux
+	}
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: serveMux}
+	// streams are not drained by http.Server.Shutdown, they watch this channel to end themselves
+	stopping := make(chan struct{})
+	httpServer.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), "serverStopping", stopping)
+	}
+	httpServer.RegisterOnShutdown(func() {
+		close(stopping)
+	})
+	return &Server{
+		HttpServer:      httpServer,
+		ShutdownTimeout: 30 * time.Second,
+		mux:             &sync.Mutex{},
+		stopped:         make(chan struct{}),
+		shutdownOnce:    &sync.Once{},
+	}
+}
@@ -0,0 +1,150 @@
+package web_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServerShutdown(t *testing.T) {
+	port := freePort(t)
+	started := make(chan struct{})
+	var drained atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		util.Write(w, []byte("done"))
+		drained.Store(true)
+	}))
+	mux.HandleFunc("/events", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		web.NewEventStream(w, r).Serve(make(chan web.Event))
+	}))
+	server := web.NewServer(mux, port)
+	server.ShutdownTimeout = 10 * time.Second
+
+	hooksMux := &sync.Mutex{}
+	hooks := make([]string, 0)
+	for _, name := range []string{"first", "second", "third"} {
+		server.AddShutdownHook(name, func() {
+			hooksMux.Lock()
+			defer hooksMux.Unlock()
+			hooks = append(hooks, fmt.Sprintf("%s drained=%v", name, drained.Load()))
+			if name == "second" {
+				panic("Hook failed")
+			}
+		})
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		server.Run()
+	}()
+	web.WaitForPort(port)
+	url := fmt.Sprintf("http://localhost:%d", port)
+
+	// streams are not drained by http.Server.Shutdown, they end when the server signals it is stopping
+	stream, err := http.Get(url + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	streamEnded := make(chan struct{})
+	go func() {
+		defer close(streamEnded)
+		_, _ = io.Copy(io.Discard, stream.Body)
+	}()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		response, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		b, err := io.ReadAll(response.Body)
+		slow <- result{status: response.StatusCode, body: string(b), err: err}
+	}()
+	<-started
+
+	t0 := time.Now()
+	process, err := os.FindProcess(os.Getpid())
+	util.CheckErr(err)
+	util.CheckErr(process.Signal(syscall.SIGTERM))
+
+	if r := <-slow; r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Fatalf("In-flight request not drained: %+v", r)
+	}
+	select {
+	case <-streamEnded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream not ended on shutdown")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if d := time.Since(t0); d >= server.ShutdownTimeout {
+		t.Fatalf("Shutdown waited the whole timeout %v", d)
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Fatal("Request accepted after shutdown")
+	}
+
+	// hooks run in reverse registration order once the requests are drained, a failing one does not stop the others
+	hooksMux.Lock()
+	defer hooksMux.Unlock()
+	expected := []string{"third drained=true", "second drained=true", "first drained=true"}
+	if fmt.Sprint(hooks) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected hooks %q", hooks)
+	}
+	server.Shutdown()
+	if len(hooks) != 3 {
+		t.Fatalf("Hooks run again by a second shutdown %q", hooks)
+	}
+}
+
+func TestServerListenFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := web.NewServer(http.NewServeMux(), listener.Addr().(*net.TCPAddr).Port)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		server.Run()
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the server failed to listen")
+	}
+}
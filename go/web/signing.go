@@ -0,0 +1,252 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/tx"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	SignatureVersionHeaderName = "Toolkit-Signature-Version"
+	NonceHeaderName            = "Toolkit-Nonce"
+	ContentSha256HeaderName    = "Toolkit-Content-Sha256"
+	SignatureVersion2          = "2"
+)
+
+// CanonicalRequest the string signed by version 2 signatures, one field per line: version, client id,
+// timestamp, nonce, method, escaped path, sorted query and the hex sha256 of the body
+func CanonicalRequest(clientId string, timestamp string, nonce string, method string, u *url.URL, bodyDigest string) string {
+	return strings.Join([]string{
+		SignatureVersion2,
+		clientId,
+		timestamp,
+		nonce,
+		strings.ToUpper(method),
+		u.EscapedPath(),
+		canonicalQuery(u.Query()),
+		bodyDigest,
+	}, "\n")
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(values))
+	for _, k := range keys {
+		vs := append([]string{}, values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func BodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	util.CheckErr(err)
+	return hex.EncodeToString(b)
+}
+
+// SignRequest sets the version 2 signature headers, the body is read through GetBody so it must be replayable
+func SignRequest(request *http.Request, clientId string, secret string) {
+	body := []byte{}
+	if request.Body != nil && request.Body != http.NoBody {
+		if request.GetBody == nil {
+			panic("Signed requests require a replayable body")
+		}
+		reader, err := request.GetBody()
+		util.CheckErr(err)
+		body, err = io.ReadAll(reader)
+		util.CheckErr(err)
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	nonce := newNonce()
+	digest := BodyDigest(body)
+	canonical := CanonicalRequest(clientId, timestamp, nonce, request.Method, request.URL, digest)
+	request.Header.Set(SignatureVersionHeaderName, SignatureVersion2)
+	request.Header.Set(ClientIdHeaderName, clientId)
+	request.Header.Set(TimestampHeaderName, timestamp)
+	request.Header.Set(NonceHeaderName, nonce)
+	request.Header.Set(ContentSha256HeaderName, digest)
+	request.Header.Set(SignatureHeaderName, CreateSignature(secret, []byte(canonical)))
+}
+
+// NonceStore remembers nonces for a while, a shared implementation is required to detect replays
+// across several instances
+type NonceStore interface {
+	// Remember returns false when the nonce was already seen and has not expired
+	Remember(key string, ttl time.Duration) bool
+}
+
+type MemoryNonceStore struct {
+	mux        *sync.Mutex
+	nonces     map[string]time.Time
+	lastShrink time.Time
+}
+
+func (o *MemoryNonceStore) Remember(key string, ttl time.Duration) bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	now := time.Now()
+	if now.Sub(o.lastShrink) > time.Minute {
+		for k, expiration := range o.nonces {
+			if expiration.Before(now) {
+				delete(o.nonces, k)
+			}
+		}
+		o.lastShrink = now
+	}
+	if expiration, ok := o.nonces[key]; ok && expiration.After(now) {
+		return false
+	}
+	o.nonces[key] = now.Add(ttl)
+	return true
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{mux: &sync.Mutex{}, nonces: make(map[string]time.Time), lastShrink: time.Now()}
+}
+
+// SignatureVerifier Secrets returns every active secret of a client so they can be rotated without downtime.
+// Legacy (version 1) signatures only cover the client id and timestamp and are rejected unless AllowLegacy,
+// they are still checked against MaxSkew but can be replayed within it.
+type SignatureVerifier struct {
+	Secrets     func(clientId string) []string
+	MaxSkew     time.Duration
+	MaxBodySize int64
+	AllowLegacy bool
+	Nonces      NonceStore
+}
+
+func StaticSecrets(secrets ...string) func(clientId string) []string {
+	return func(clientId string) []string {
+		return secrets
+	}
+}
+
+func ClientSecrets(secrets map[string][]string) func(clientId string) []string {
+	return func(clientId string) []string {
+		return secrets[clientId]
+	}
+}
+
+// Verify checks the request signature and returns the client id. The body is buffered and restored.
+func (o *SignatureVerifier) Verify(r *http.Request) string {
+	clientId := r.Header.Get(ClientIdHeaderName)
+	signature := r.Header.Get(SignatureHeaderName)
+	if clientId == "" || signature == "" {
+		panic("Invalid signature")
+	}
+	secrets := o.Secrets(clientId)
+	if len(secrets) == 0 {
+		panic("Invalid signature")
+	}
+	timestamp := r.Header.Get(TimestampHeaderName)
+	version := r.Header.Get(SignatureVersionHeaderName)
+	if version == "" {
+		if !o.AllowLegacy {
+			panic("Unsupported signature version")
+		}
+		o.checkTimestamp(timestamp)
+		o.verifySignature(secrets, signature, []byte(clientId+"."+timestamp))
+		return clientId
+	}
+	if version != SignatureVersion2 {
+		panic("Unsupported signature version")
+	}
+	o.checkTimestamp(timestamp)
+	nonce := r.Header.Get(NonceHeaderName)
+	if len(nonce) < 16 {
+		panic("Invalid signature nonce")
+	}
+	body := o.readBody(r)
+	digest := BodyDigest(body)
+	if r.Header.Get(ContentSha256HeaderName) != digest {
+		panic("Body digest mismatch")
+	}
+	o.verifySignature(secrets, signature, []byte(CanonicalRequest(clientId, timestamp, nonce, r.Method, r.URL, digest)))
+	if !o.Nonces.Remember(clientId+"."+nonce, 2*o.MaxSkew) {
+		panic("Replayed request")
+	}
+	return clientId
+}
+
+func (o *SignatureVerifier) checkTimestamp(timestamp string) {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		panic("Invalid signature timestamp")
+	}
+	skew := time.Since(t)
+	if skew > o.MaxSkew || skew < -o.MaxSkew {
+		panic("Signature timestamp out of the allowed window")
+	}
+}
+
+func (o *SignatureVerifier) verifySignature(secrets []string, signature string, data []byte) {
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signature), []byte(CreateSignature(secret, data))) {
+			return
+		}
+	}
+	panic("Invalid signature")
+}
+
+func (o *SignatureVerifier) readBody(r *http.Request) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return []byte{}
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, o.MaxBodySize))
+	util.CheckErr(err)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+func NewSignatureVerifier(secrets func(clientId string) []string) *SignatureVerifier {
+	return &SignatureVerifier{
+		Secrets:     secrets,
+		MaxSkew:     5 * time.Minute,
+		MaxBodySize: 10 * 1024 * 1024,
+		Nonces:      NewMemoryNonceStore(),
+	}
+}
+
+func InterceptSignedWith(verifier *SignatureVerifier, delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientId := verifier.Verify(r)
+		setRequestUser(r, clientId)
+		ctx := context.WithValue(r.Context(), "clientId", clientId)
+		delegate(w, r.WithContext(ctx))
+	}
+}
+
+func ConfigureHandlerSignedWith(serveMux *http.ServeMux, path string, verifier *SignatureVerifier, f func(w http.ResponseWriter, r *http.Request)) {
+	serveMux.HandleFunc(path, InterceptFatal(InterceptCORS(InterceptSignedWith(verifier, f))))
+}
+
+func ConfigureHandlerSignedWithTransactional(serveMux *http.ServeMux, path string, verifier *SignatureVerifier, databaseConfig sql.DatasourceConfig, f func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request)) {
+	serveMux.HandleFunc(path, InterceptFatal(InterceptCORS(InterceptSignedWith(verifier, tx.InterceptTransactional(databaseConfig, f)))))
+}
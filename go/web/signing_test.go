@@ -0,0 +1,89 @@
+package web_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+	"time"
+)
+
+func TestSignedRequests(t *testing.T) {
+	verifier := web.NewSignatureVerifier(web.ClientSecrets(map[string][]string{"client": {"old", "new"}}))
+	handler := web.InterceptFatal(web.InterceptSignedWith(verifier, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	send := func(request *http.Request) int {
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder.Code
+	}
+	newRequest := func(body string) *http.Request {
+		request, err := http.NewRequest(http.MethodPost, "http://localhost/items?b=2&a=1", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		web.SignRequest(request, "client", "old")
+		return request
+	}
+
+	request := newRequest(`{"id":1}`)
+	replay := request.Clone(request.Context())
+	replay.Body, _ = request.GetBody()
+	if code := send(request); code != http.StatusNoContent {
+		t.Fatalf("Valid request rejected with %d", code)
+	}
+	if code := send(replay); code == http.StatusNoContent {
+		t.Fatal("Replayed request accepted")
+	}
+
+	tampered := newRequest(`{"id":1}`)
+	tampered.Body, _ = newRequest(`{"id":2}`).GetBody()
+	if code := send(tampered); code == http.StatusNoContent {
+		t.Fatal("Tampered body accepted")
+	}
+
+	moved := newRequest(`{"id":1}`)
+	moved.URL.Path = "/other"
+	if code := send(moved); code == http.StatusNoContent {
+		t.Fatal("Tampered path accepted")
+	}
+
+	stale := newRequest(`{"id":1}`)
+	stale.Header.Set(web.TimestampHeaderName, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	if code := send(stale); code == http.StatusNoContent {
+		t.Fatal("Stale request accepted")
+	}
+}
+
+func TestLegacySignatures(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	legacy := func(timestamp time.Time) *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/items", nil)
+		ts := timestamp.Format(time.RFC3339)
+		request.Header.Set(web.ClientIdHeaderName, "client")
+		request.Header.Set(web.TimestampHeaderName, ts)
+		request.Header.Set(web.SignatureHeaderName, web.CreateSignature("secret", []byte("client."+ts)))
+		return request
+	}
+	cases := []struct {
+		handler http.HandlerFunc
+		request *http.Request
+		status  int
+	}{
+		{web.InterceptFatal(web.InterceptSigned("secret", ok)), legacy(time.Now()), http.StatusInternalServerError},
+		{web.InterceptFatal(web.InterceptSignedLegacy("secret", ok)), legacy(time.Now()), http.StatusNoContent},
+		{web.InterceptFatal(web.InterceptSignedLegacy("secret", ok)), legacy(time.Now().Add(-time.Hour)), http.StatusInternalServerError},
+	}
+	for i, c := range cases {
+		recorder := httptest.NewRecorder()
+		c.handler(recorder, c.request)
+		if recorder.Code != c.status {
+			t.Fatalf("Case %d: unexpected status %d, expected %d", i, recorder.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	ContentTypeEventStream = "text/event-stream"
+	HeaderLastEventId      = "Last-Event-ID"
+)
+
+// Event Data is sent as is when it is a string or []byte, as json otherwise. Retry tells the client
+// how long to wait before reconnecting.
+type Event struct {
+	Id    string
+	Name  string
+	Data  interface{}
+	Retry time.Duration
+}
+
+// EventStream a Server-Sent Events response. Writes go through the handler goroutine only, use Serve to
+// forward events from other goroutines.
+type EventStream struct {
+	Heartbeat   time.Duration
+	w           http.ResponseWriter
+	r           *http.Request
+	controller  *http.ResponseController
+	lastEventId string
+	closed      bool
+}
+
+// LastEventId the id of the last event received by the client before reconnecting, empty on the first connection
+func (o *EventStream) LastEventId() string {
+	return o.lastEventId
+}
+
+// Done closed when the client goes away or the server shuts down
+func (o *EventStream) Done() <-chan struct{} {
+	stopping := serverStopping(o.r)
+	if stopping == nil {
+		return o.r.Context().Done()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-o.r.Context().Done():
+		case <-stopping:
+		}
+	}()
+	return done
+}
+
+// Send returns false once the client is gone, further sends are ignored
+func (o *EventStream) Send(event Event) bool {
+	buffer := &bytes.Buffer{}
+	if event.Id != "" {
+		buffer.WriteString("id: " + singleLine(event.Id) + "\n")
+	}
+	if event.Name != "" {
+		buffer.WriteString("event: " + singleLine(event.Name) + "\n")
+	}
+	if event.Retry > 0 {
+		buffer.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	var data string
+	switch v := event.Data.(type) {
+	case nil:
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	default:
+		data = string(util.Marshal(v))
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		buffer.WriteString("data: " + line + "\n")
+	}
+	buffer.WriteString("\n")
+	return o.write(buffer.Bytes())
+}
+
+// SendHeartbeat a comment line keeping proxies from closing an idle connection
+func (o *EventStream) SendHeartbeat() bool {
+	return o.write([]byte(": heartbeat\n\n"))
+}
+
+func (o *EventStream) write(b []byte) bool {
+	if o.closed {
+		return false
+	}
+	if o.r.Context().Err() != nil {
+		o.closed = true
+		return false
+	}
+	_, err := o.w.Write(b)
+	if err == nil {
+		err = o.controller.Flush()
+	}
+	if err != nil {
+		util.LogContext(o.r.Context(), "debug").Printf("Event stream %s closed: %v", o.r.URL.Path, err)
+		o.closed = true
+		return false
+	}
+	return true
+}
+
+// Serve sends the events until the channel is closed, the client goes away or the server shuts down.
+// Heartbeats are sent when no event went out for Heartbeat.
+func (o *EventStream) Serve(events <-chan Event) {
+	done := o.Done()
+	timer := time.NewTimer(o.Heartbeat)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-events:
+			if !ok || !o.Send(event) {
+				return
+			}
+		case <-timer.C:
+			if !o.SendHeartbeat() {
+				return
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(o.Heartbeat)
+	}
+}
+
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// NewEventStream sends the stream headers. The response is excluded from compression, from the latency
+// stats and from the server write timeout.
+func NewEventStream(w http.ResponseWriter, r *http.Request) *EventStream {
+	lastEventId := r.Header.Get(HeaderLastEventId)
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	markStreaming(w, http.StatusOK)
+	controller := http.NewResponseController(w)
+	err := controller.SetWriteDeadline(time.Time{})
+	if err != nil && err != http.ErrNotSupported {
+		panic(fmt.Sprintf("Cannot clear the write deadline: %v", err))
+	}
+	header := w.Header()
+	header.Set(HeaderContentType, ContentTypeEventStream)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	header.Del(HeaderContentLength)
+	w.WriteHeader(http.StatusOK)
+	stream := &EventStream{
+		Heartbeat:   15 * time.Second,
+		w:           w,
+		r:           r,
+		controller:  controller,
+		lastEventId: lastEventId,
+	}
+	if err := controller.Flush(); err != nil {
+		stream.closed = true
+	}
+	return stream
+}
@@ -0,0 +1,86 @@
+package web_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/web"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	streams := streamCount(t, "/events")
+	served := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", web.InterceptFatal(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		stream := web.NewEventStream(w, r)
+		stream.Heartbeat = 10 * time.Millisecond
+		events := make(chan web.Event, 2)
+		events <- web.Event{Id: stream.LastEventId() + "1", Name: "progress", Data: map[string]int{"done": 50}}
+		events <- web.Event{Id: stream.LastEventId() + "2", Data: "line 1\nline 2"}
+		stream.Serve(events)
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	request.Header.Set(web.HeaderLastEventId, "a")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Get(web.HeaderContentType) != web.ContentTypeEventStream {
+		t.Fatalf("Unexpected content type %s", response.Header.Get(web.HeaderContentType))
+	}
+	reader := bufio.NewReader(response.Body)
+	lines := make([]string, 0)
+	for len(lines) < 9 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+	expected := []string{"id: a1", "event: progress", `data: {"done":50}`, "", "id: a2", "data: line 1", "data: line 2", "", ": heartbeat"}
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Unexpected stream %q", lines)
+	}
+	response.Body.Close()
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect not detected")
+	}
+	// stats are recorded once the handler returns
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if streamCount(t, "/events") == streams+1 {
+			return
+		}
+	}
+	t.Fatal("Stream not recorded")
+}
+
+func streamCount(t *testing.T, path string) int64 {
+	recorder := httptest.NewRecorder()
+	web.StatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	snapshot := []struct {
+		Path          string `json:"path"`
+		AccumCounters struct {
+			StreamCount int64 `json:"streamCount"`
+		} `json:"accumCounters"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshot {
+		if s.Path == path {
+			return s.AccumCounters.StreamCount
+		}
+	}
+	return 0
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -12,10 +13,24 @@ import (
 )
 
 type statsCounters struct {
-	InCount         int64
-	OutCount        int64
-	TotalDuration   int64
-	AverageDuration int64
+	InCount         int64             `json:"inCount"`
+	OutCount        int64             `json:"outCount"`
+	TotalDuration   int64             `json:"totalDuration"`
+	AverageDuration int64             `json:"averageDuration"`
+	RejectedCount   int64             `json:"rejectedCount"`
+	DeniedCount     int64             `json:"deniedCount"`
+	StreamCount     int64             `json:"streamCount"`
+	StreamDuration  int64             `json:"streamDuration"`
+	Status1xx       int64             `json:"status1xx"`
+	Status2xx       int64             `json:"status2xx"`
+	Status3xx       int64             `json:"status3xx"`
+	Status4xx       int64             `json:"status4xx"`
+	Status5xx       int64             `json:"status5xx"`
+	P50             float64           `json:"p50"`
+	P90             float64           `json:"p90"`
+	P99             float64           `json:"p99"`
+	Max             float64           `json:"max"`
+	histogram       *latencyHistogram `json:"-"`
 }
 
 func (o *statsCounters) Copy(other statsCounters) {
@@ -23,17 +38,159 @@ func (o *statsCounters) Copy(other statsCounters) {
 	o.OutCount = other.OutCount
 	o.TotalDuration = other.TotalDuration
 	o.AverageDuration = other.AverageDuration
+	o.RejectedCount = other.RejectedCount
+	o.DeniedCount = other.DeniedCount
+	o.StreamCount = other.StreamCount
+	o.StreamDuration = other.StreamDuration
+	o.Status1xx = other.Status1xx
+	o.Status2xx = other.Status2xx
+	o.Status3xx = other.Status3xx
+	o.Status4xx = other.Status4xx
+	o.Status5xx = other.Status5xx
+	o.P50 = other.histogram.Percentile(0.5)
+	o.P90 = other.histogram.Percentile(0.9)
+	o.P99 = other.histogram.Percentile(0.99)
+	o.Max = other.histogram.Max()
+}
+
+func (o *statsCounters) pushOut(duration time.Duration, status int) {
+	o.OutCount++
+	o.TotalDuration += duration.Milliseconds()
+	o.AverageDuration = int64(float64(o.TotalDuration) / float64(o.OutCount-o.StreamCount))
+	o.histogram.Record(duration)
+	o.countStatus(status)
+}
+
+// pushStreamOut streams (event streams, websockets) stay out of the latency figures
+func (o *statsCounters) pushStreamOut(duration time.Duration, status int) {
+	o.OutCount++
+	o.StreamCount++
+	o.StreamDuration += duration.Milliseconds()
+	o.countStatus(status)
+}
+
+func (o *statsCounters) countStatus(status int) {
+	switch status / 100 {
+	case 1:
+		o.Status1xx++
+	case 2:
+		o.Status2xx++
+	case 3:
+		o.Status3xx++
+	case 4:
+		o.Status4xx++
+	default:
+		o.Status5xx++
+	}
+}
+
+func (o *statsCounters) reset() {
+	histogram := o.histogram
+	histogram.Reset()
+	*o = statsCounters{histogram: histogram}
+}
+
+func newStatsCounters() *statsCounters {
+	return &statsCounters{histogram: &latencyHistogram{}}
+}
+
+// statsWriter captures the status code and body size of the response, streaming is set by
+// long-lived responses so they are not recorded as slow requests
+type statsWriter struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64
+	streaming bool
+}
+
+func (o *statsWriter) WriteHeader(status int) {
+	if o.status == 0 && status >= http.StatusOK {
+		o.status = status
+	}
+	o.ResponseWriter.WriteHeader(status)
+}
+
+func (o *statsWriter) Write(b []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	n, err := o.ResponseWriter.Write(b)
+	o.bytes += int64(n)
+	return n, err
+}
+
+func (o *statsWriter) Flush() {
+	_ = o.FlushError()
+}
+
+func (o *statsWriter) FlushError() error {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	return http.NewResponseController(o.ResponseWriter).Flush()
+}
+
+func (o *statsWriter) Unwrap() http.ResponseWriter {
+	return o.ResponseWriter
+}
+
+// Status the status sent, 200 when the handler wrote nothing
+func (o *statsWriter) Status() int {
+	if o.status == 0 {
+		return http.StatusOK
+	}
+	return o.status
+}
+
+func (o *statsWriter) Bytes() int64 {
+	return o.bytes
+}
+
+// responseStatus the status recorded by the statsWriter down the Unwrap chain, if any
+func responseStatus(w http.ResponseWriter) (int, bool) {
+	for {
+		switch v := w.(type) {
+		case *statsWriter:
+			return v.Status(), true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return 0, false
+		}
+	}
+}
+
+// markStreaming looks for the statsWriter down the Unwrap chain, status is recorded for hijacked connections
+func markStreaming(w http.ResponseWriter, status int) {
+	for {
+		switch v := w.(type) {
+		case *statsWriter:
+			v.streaming = true
+			v.status = status
+			return
+		case *committedWriter:
+			v.committed = true
+			w = v.Unwrap()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return
+		}
+	}
 }
 
 type pathStats struct {
-	Path            *string
-	IntervalCounter *statsCounters
-	AccumCounters   *statsCounters
+	Path            *string        `json:"path"`
+	OpenWebSockets  int64          `json:"openWebSockets"`
+	IntervalCounter *statsCounters `json:"intervalCounter"`
+	AccumCounters   *statsCounters `json:"accumCounters"`
 }
 
 type webStats struct {
-	mux   *sync.Mutex
-	paths map[string]*pathStats
+	mux    *sync.Mutex
+	paths  map[string]*pathStats
+	ticker *time.Ticker
+	done   chan struct{}
 }
 
 func (o *webStats) PushIn(path string) {
@@ -44,40 +201,70 @@ func (o *webStats) PushIn(path string) {
 	pathStats.AccumCounters.InCount++
 }
 
-func (o *webStats) PushOut(path string, duration int64) {
+func (o *webStats) PushOut(path string, duration time.Duration, status int) {
 	o.mux.Lock()
 	defer o.mux.Unlock()
 	pathStats := o.resolvePathStats(path)
-	pathStats.IntervalCounter.OutCount++
-	pathStats.IntervalCounter.TotalDuration += duration
-	pathStats.IntervalCounter.AverageDuration = int64(float64(pathStats.IntervalCounter.TotalDuration) / float64(pathStats.IntervalCounter.OutCount))
-	pathStats.AccumCounters.OutCount++
-	pathStats.AccumCounters.TotalDuration += duration
-	pathStats.AccumCounters.AverageDuration = int64(float64(pathStats.AccumCounters.TotalDuration) / float64(pathStats.AccumCounters.OutCount))
+	pathStats.IntervalCounter.pushOut(duration, status)
+	pathStats.AccumCounters.pushOut(duration, status)
+}
+
+func (o *webStats) PushStreamOut(path string, duration time.Duration, status int) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pathStats := o.resolvePathStats(path)
+	pathStats.IntervalCounter.pushStreamOut(duration, status)
+	pathStats.AccumCounters.pushStreamOut(duration, status)
+}
+
+// PushWebSocket delta is 1 on upgrade and -1 on close
+func (o *webStats) PushWebSocket(path string, delta int64) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.resolvePathStats(path).OpenWebSockets += delta
+}
+
+func (o *webStats) PushRejected(path string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pathStats := o.resolvePathStats(path)
+	pathStats.IntervalCounter.RejectedCount++
+	pathStats.AccumCounters.RejectedCount++
+}
+
+// PushDenied requests refused by an IP filter
+func (o *webStats) PushDenied(path string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pathStats := o.resolvePathStats(path)
+	pathStats.IntervalCounter.DeniedCount++
+	pathStats.AccumCounters.DeniedCount++
 }
 
 func (o *webStats) resolvePathStats(path string) *pathStats {
 	stats, ok := o.paths[path]
 	if !ok {
 		stats = &pathStats{
-			Path: &path,
-			IntervalCounter: &statsCounters{
-				InCount:         0,
-				OutCount:        0,
-				AverageDuration: 0,
-			},
-			AccumCounters: &statsCounters{
-				InCount:         0,
-				OutCount:        0,
-				AverageDuration: 0,
-			},
+			Path:            &path,
+			IntervalCounter: newStatsCounters(),
+			AccumCounters:   newStatsCounters(),
 		}
 		o.paths[path] = stats
 	}
 	return stats
 }
 
+// CheckPoint returns a copy of the counters and starts a new interval
 func (o *webStats) CheckPoint() []pathStats {
+	return o.checkPoint(true)
+}
+
+// Snapshot same as CheckPoint but the current interval goes on
+func (o *webStats) Snapshot() []pathStats {
+	return o.checkPoint(false)
+}
+
+func (o *webStats) checkPoint(reset bool) []pathStats {
 	o.mux.Lock()
 	defer o.mux.Unlock()
 	result := make([]pathStats, len(o.paths))
@@ -85,31 +272,57 @@ func (o *webStats) CheckPoint() []pathStats {
 	for _, v := range o.paths {
 		clone := pathStats{
 			Path:            v.Path,
+			OpenWebSockets:  v.OpenWebSockets,
 			IntervalCounter: &statsCounters{},
 			AccumCounters:   &statsCounters{},
 		}
 		clone.IntervalCounter.Copy(*v.IntervalCounter)
 		clone.AccumCounters.Copy(*v.AccumCounters)
 		result[i] = clone
-		v.IntervalCounter.InCount = 0
-		v.IntervalCounter.OutCount = 0
-		v.IntervalCounter.TotalDuration = 0
-		v.IntervalCounter.AverageDuration = 0
+		if reset {
+			v.IntervalCounter.reset()
+		}
 		i++
 	}
 	return result
 }
 
 func (o *webStats) Start() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.ticker != nil {
+		return
+	}
 	util.Log("web").Println("Web services metering activated")
 	ticker := time.NewTicker(time.Minute)
+	done := make(chan struct{})
+	o.ticker = ticker
+	o.done = done
 	go func() {
-		for range ticker.C {
-			o.report()
+		for {
+			select {
+			case <-ticker.C:
+				o.report()
+			case <-done:
+				return
+			}
 		}
 	}()
 }
 
+func (o *webStats) Stop() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.ticker == nil {
+		return
+	}
+	o.ticker.Stop()
+	close(o.done)
+	o.ticker = nil
+	o.done = nil
+	util.Log("web").Println("Web services metering stopped")
+}
+
 func (o *webStats) report() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -121,13 +334,24 @@ func (o *webStats) report() {
 		return strings.Compare(*snapshot[i].Path, *snapshot[j].Path) > 0
 	})
 	buffer := bytes.Buffer{}
-	buffer.WriteString(fmt.Sprintf("%-60s%15s%15s%15s%15s%15s%15s%15s%15s\r\n",
-		"Path", "In", "Out", "Sum ms", "Avg ms", "Accum. In", "Out", "Sum ms", "Avg ms"))
+	buffer.WriteString(fmt.Sprintf("%-60s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s%15s\r\n",
+		"Path", "In", "Out", "Sum ms", "Avg ms", "P50 ms", "P90 ms", "P99 ms", "Max ms", "2xx", "3xx", "4xx", "5xx", "Rejected", "Denied", "Streams", "WebSockets",
+		"Accum. In", "Out", "Sum ms", "Avg ms", "Rejected", "Denied"))
 	for _, v := range snapshot {
-		buffer.WriteString(fmt.Sprintf("%-60s%15d%15d%15d%15d%15d%15d%15d%15d\r\n",
+		c := v.IntervalCounter
+		a := v.AccumCounters
+		buffer.WriteString(fmt.Sprintf("%-60s%15d%15d%15d%15d%15.1f%15.1f%15.1f%15.1f%15d%15d%15d%15d%15d%15d%15d%15d%15d%15d%15d%15d%15d%15d\r\n",
 			*v.Path,
-			v.IntervalCounter.InCount, v.IntervalCounter.OutCount, v.IntervalCounter.TotalDuration, v.IntervalCounter.AverageDuration,
-			v.AccumCounters.InCount, v.AccumCounters.OutCount, v.AccumCounters.TotalDuration, v.AccumCounters.AverageDuration))
+			c.InCount, c.OutCount, c.TotalDuration, c.AverageDuration, c.P50, c.P90, c.P99, c.Max,
+			c.Status2xx, c.Status3xx, c.Status4xx, c.Status5xx, c.RejectedCount, c.DeniedCount, c.StreamCount, v.OpenWebSockets,
+			a.InCount, a.OutCount, a.TotalDuration, a.AverageDuration, a.RejectedCount, a.DeniedCount))
+	}
+	breakerSnapshot := BreakerStats()
+	if len(breakerSnapshot) > 0 {
+		buffer.WriteString(fmt.Sprintf("%-60s%15s%15s%15s%15s%15s\r\n", "Breaker", "State", "Requests", "Failures", "Rejected", "Trips"))
+		for _, b := range breakerSnapshot {
+			buffer.WriteString(fmt.Sprintf("%-60s%15s%15d%15d%15d%15d\r\n", b.Name, b.State.String(), b.TotalRequests, b.TotalFailures, b.TotalRejected, b.Trips))
+		}
 	}
 	util.Log("web").Printf("Web services stats:\r\n%s", buffer.String())
 }
@@ -141,6 +365,23 @@ func newStats() *webStats {
 
 var stats = newStats()
 
+// StatsHandler renders the current counters as json without closing the interval
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := stats.Snapshot()
+	sort.Slice(snapshot, func(i, j int) bool {
+		return strings.Compare(*snapshot[i].Path, *snapshot[j].Path) < 0
+	})
+	JsonResponse(snapshot, w)
+}
+
+func ConfigureStatsHandler(serveMux *http.ServeMux, path string, secret string) {
+	ConfigureHandlerSecret(serveMux, path, secret, StatsHandler)
+}
+
 func InitWebStats() {
 	stats.Start()
 }
+
+func StopWebStats() {
+	stats.Stop()
+}
@@ -0,0 +1,61 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsCounters(t *testing.T) {
+	s := newStats()
+	for _, status := range []int{100, 200, 204, 301, 404, 429, 500, 503, 0} {
+		s.PushIn("/a")
+		s.PushOut("/a", 10*time.Millisecond, status)
+	}
+	s.PushIn("/a")
+	s.PushStreamOut("/a", time.Minute, 200)
+	s.PushRejected("/a")
+	s.PushDenied("/a")
+	s.PushWebSocket("/a", 1)
+
+	expected := statsCounters{InCount: 10, OutCount: 10, TotalDuration: 90, AverageDuration: 10, RejectedCount: 1, DeniedCount: 1,
+		StreamCount: 1, StreamDuration: 60000, Status1xx: 1, Status2xx: 3, Status3xx: 1, Status4xx: 2, Status5xx: 3}
+	check := func(name string, counters *statsCounters, expected statsCounters) {
+		counters.P50, counters.P90, counters.P99, counters.Max = 0, 0, 0, 0
+		if *counters != expected {
+			t.Fatalf("Unexpected %s counters %+v, expected %+v", name, *counters, expected)
+		}
+	}
+	pathStats := func(snapshot []pathStats) pathStats {
+		if len(snapshot) != 1 || *snapshot[0].Path != "/a" || snapshot[0].OpenWebSockets != 1 {
+			t.Fatalf("Unexpected snapshot %+v", snapshot)
+		}
+		return snapshot[0]
+	}
+
+	// a snapshot keeps the interval going
+	for i := 0; i < 2; i++ {
+		snapshot := pathStats(s.Snapshot())
+		if snapshot.IntervalCounter.P50 != 10 || snapshot.IntervalCounter.Max != 10 {
+			t.Fatalf("Unexpected latency %+v", *snapshot.IntervalCounter)
+		}
+		check("interval", snapshot.IntervalCounter, expected)
+		check("accumulated", snapshot.AccumCounters, expected)
+	}
+
+	// a check point returns the interval and starts a new one, including its latency histogram
+	check("check point", pathStats(s.CheckPoint()).IntervalCounter, expected)
+	snapshot := pathStats(s.Snapshot())
+	if snapshot.IntervalCounter.P99 != 0 || snapshot.IntervalCounter.Max != 0 || snapshot.AccumCounters.Max != 10 {
+		t.Fatalf("Unexpected latency after the check point %+v %+v", *snapshot.IntervalCounter, *snapshot.AccumCounters)
+	}
+	check("interval after the check point", snapshot.IntervalCounter, statsCounters{})
+	check("accumulated after the check point", snapshot.AccumCounters, expected)
+
+	s.PushIn("/a")
+	s.PushOut("/a", 30*time.Millisecond, 201)
+	snapshot = pathStats(s.Snapshot())
+	if snapshot.IntervalCounter.Max != 30 || snapshot.IntervalCounter.P50 != 30 {
+		t.Fatalf("Unexpected latency of the new interval %+v", *snapshot.IntervalCounter)
+	}
+	check("new interval", snapshot.IntervalCounter, statsCounters{InCount: 1, OutCount: 1, TotalDuration: 30, AverageDuration: 30, Status2xx: 1})
+}
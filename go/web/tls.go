@@ -0,0 +1,296 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+type TlsConfig struct {
+	CertFile       *string  `json:"certFile"`
+	KeyFile        *string  `json:"keyFile"`
+	MinVersion     *string  `json:"minVersion"`
+	CipherSuites   []string `json:"cipherSuites"`
+	ClientCaFile   *string  `json:"clientCaFile"`
+	ClientAuth     *string  `json:"clientAuth"`
+	ReloadInterval *int     `json:"reloadInterval"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+func (o *TlsConfig) Validate() {
+	if o.CertFile == nil {
+		panic("Invalid certFile")
+	}
+	if o.KeyFile == nil {
+		panic("Invalid keyFile")
+	}
+	if o.MinVersion != nil {
+		if _, ok := tlsVersions[*o.MinVersion]; !ok {
+			panic(fmt.Sprintf("Invalid minVersion %s, supported: 1.2, 1.3", *o.MinVersion))
+		}
+	}
+	if o.ClientAuth != nil {
+		if _, ok := clientAuthTypes[*o.ClientAuth]; !ok {
+			panic(fmt.Sprintf("Invalid clientAuth %s", *o.ClientAuth))
+		}
+		if *o.ClientAuth == "verify-if-given" || *o.ClientAuth == "require-and-verify" {
+			if o.ClientCaFile == nil {
+				panic("clientCaFile required to verify client certificates")
+			}
+		}
+	}
+	resolveCipherSuites(o.CipherSuites)
+}
+
+// resolveCipherSuites only the suites go considers secure are accepted. TLS 1.3 suites are not configurable.
+func resolveCipherSuites(names []string) []uint16 {
+	if len(names) == 0 {
+		return nil
+	}
+	available := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		available[s.Name] = s.ID
+	}
+	result := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := available[name]
+		if !ok {
+			panic(fmt.Sprintf("Unsupported cipher suite %s", name))
+		}
+		result[i] = id
+	}
+	return result
+}
+
+// CertificateReloader keeps the server certificate and client CA pool in sync with the files on disk.
+// A failed reload keeps the previous material in place.
+type CertificateReloader struct {
+	config      TlsConfig
+	mux         *sync.RWMutex
+	certificate *tls.Certificate
+	clientCas   *x509.CertPool
+	modTimes    map[string]time.Time
+	done        chan struct{}
+	stopOnce    *sync.Once
+}
+
+func (o *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	return o.certificate, nil
+}
+
+func (o *CertificateReloader) ClientCas() *x509.CertPool {
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	return o.clientCas
+}
+
+// currentModTimes the files' modification times and whether any differs from the last successful load
+func (o *CertificateReloader) currentModTimes() (map[string]time.Time, bool) {
+	files := []string{*o.config.CertFile, *o.config.KeyFile}
+	if o.config.ClientCaFile != nil {
+		files = append(files, *o.config.ClientCaFile)
+	}
+	result := make(map[string]time.Time)
+	changed := false
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			util.Log("warning").Printf("Could not stat %s: %v", f, err)
+			result[f] = o.modTimes[f]
+			continue
+		}
+		result[f] = info.ModTime()
+		if !info.ModTime().Equal(o.modTimes[f]) {
+			changed = true
+		}
+	}
+	return result, changed
+}
+
+// Reload loads the files when any of them changed since the last successful load, so files caught half
+// written are loaded again on the next call. Until a certificate is loaded they are loaded unconditionally,
+// so missing files panic at startup.
+func (o *CertificateReloader) Reload() {
+	modTimes, changed := o.currentModTimes()
+	o.mux.RLock()
+	loaded := o.certificate != nil
+	o.mux.RUnlock()
+	if !changed && loaded {
+		return
+	}
+	certificate, err := tls.LoadX509KeyPair(*o.config.CertFile, *o.config.KeyFile)
+	util.CheckErr(err)
+	var clientCas *x509.CertPool
+	if o.config.ClientCaFile != nil {
+		pem, err := os.ReadFile(*o.config.ClientCaFile)
+		util.CheckErr(err)
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(pem) {
+			panic(fmt.Sprintf("No certificates found in %s", *o.config.ClientCaFile))
+		}
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.certificate = &certificate
+	o.clientCas = clientCas
+	o.modTimes = modTimes
+	util.Log("info").Printf("Loaded certificate %s", *o.config.CertFile)
+}
+
+func (o *CertificateReloader) safeReload() {
+	defer func() {
+		if r := recover(); r != nil {
+			util.ProcessError(fmt.Sprintf("Certificate reload failed, keeping the current one: %v", r))
+		}
+	}()
+	o.Reload()
+}
+
+func (o *CertificateReloader) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.safeReload()
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+func (o *CertificateReloader) Stop() {
+	o.stopOnce.Do(func() {
+		close(o.done)
+	})
+}
+
+// TlsConfig builds the tls.Config for http.Server, certificates are resolved per handshake
+func (o *CertificateReloader) TlsConfig() *tls.Config {
+	result := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites:   resolveCipherSuites(o.config.CipherSuites),
+		GetCertificate: o.GetCertificate,
+	}
+	if o.config.MinVersion != nil {
+		result.MinVersion = tlsVersions[*o.config.MinVersion]
+	}
+	if o.config.ClientAuth != nil {
+		result.ClientAuth = clientAuthTypes[*o.config.ClientAuth]
+	}
+	if o.config.ClientCaFile != nil {
+		base := result
+		result = base.Clone()
+		result.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			perClient := base.Clone()
+			perClient.ClientCAs = o.ClientCas()
+			return perClient, nil
+		}
+	}
+	return result
+}
+
+// NewCertificateReloader loads the certificate right away and, when reloadInterval is set, polls the
+// files for changes until Stop
+func NewCertificateReloader(config TlsConfig) *CertificateReloader {
+	config.Validate()
+	reloader := &CertificateReloader{
+		config:   config,
+		mux:      &sync.RWMutex{},
+		modTimes: make(map[string]time.Time),
+		done:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+	reloader.Reload()
+	if config.ReloadInterval != nil && *config.ReloadInterval > 0 {
+		reloader.start(time.Duration(*config.ReloadInterval) * time.Second)
+	}
+	return reloader
+}
+
+func ClientCertificateSubject(r *http.Request) string {
+	if v, ok := r.Context().Value("clientCertificateSubject").(string); ok {
+		return v
+	}
+	return ""
+}
+
+// InterceptClientCertificate stores the subject of the verified client certificate in the context. Certificates
+// accepted without verification, clientAuth "request" or "require", are ignored since anyone can issue them.
+func InterceptClientCertificate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			subject := r.TLS.VerifiedChains[0][0].Subject.String()
+			r = r.WithContext(context.WithValue(r.Context(), "clientCertificateSubject", subject))
+		}
+		delegate.ServeHTTP(w, r)
+	})
+}
+
+// ConfigureTls switches the server to https, the reloader is stopped on shutdown
+func (o *Server) ConfigureTls(config TlsConfig) {
+	reloader := NewCertificateReloader(config)
+	o.HttpServer.TLSConfig = reloader.TlsConfig()
+	o.HttpServer.Handler = InterceptClientCertificate(o.HttpServer.Handler)
+	o.AddShutdownHook("certificate reloader", reloader.Stop)
+}
+
+func ListenTLS(httpServer *http.Server) {
+	err := httpServer.ListenAndServeTLS("", "")
+	if err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+func ListenAndWaitTLS(serveMux *http.ServeMux, port int, config TlsConfig) *http.Server {
+	localAddress := fmt.Sprintf(":%d", port)
+	util.Log("info").Println("Starting https server at " + localAddress)
+	reloader := NewCertificateReloader(config)
+	httpServer := &http.Server{Addr: localAddress, Handler: InterceptClientCertificate(serveMux), TLSConfig: reloader.TlsConfig()}
+	httpServer.RegisterOnShutdown(reloader.Stop)
+	go ListenTLS(httpServer)
+	WaitForPort(port)
+	return httpServer
+}
+
+// WaitForPort blocks until something accepts connections at the local port
+func WaitForPort(port int) {
+	n := 0
+	for {
+		if n > 10 {
+			panic(fmt.Sprintf("Nothing listening at port %d", port))
+		}
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), time.Second)
+		if err == nil {
+			util.SafeClose(conn)
+			return
+		}
+		util.Log("warning").Printf("%v. Retrying...", err)
+		n++
+		time.Sleep(time.Millisecond * 500)
+	}
+}
@@ -0,0 +1,124 @@
+package web_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+	"time"
+)
+
+func selfSignedCertificate(t *testing.T, commonName string) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.CheckErr(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	util.CheckErr(err)
+	certificate, err := x509.ParseCertificate(der)
+	util.CheckErr(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	util.CheckErr(err)
+	return certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	write := func(certPem []byte, keyPem []byte, modTime time.Time) {
+		util.CheckErr(os.WriteFile(certFile, certPem, 0600))
+		util.CheckErr(os.WriteFile(keyFile, keyPem, 0600))
+		util.CheckErr(os.Chtimes(certFile, modTime, modTime))
+		util.CheckErr(os.Chtimes(keyFile, modTime, modTime))
+	}
+	subject := func(reloader *web.CertificateReloader) string {
+		certificate, err := reloader.GetCertificate(nil)
+		util.CheckErr(err)
+		parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+		util.CheckErr(err)
+		return parsed.Subject.CommonName
+	}
+
+	_, certPem, keyPem := selfSignedCertificate(t, "first")
+	write(certPem, keyPem, time.Now().Add(-time.Minute))
+	reloader := web.NewCertificateReloader(web.TlsConfig{CertFile: &certFile, KeyFile: &keyFile})
+	defer reloader.Stop()
+	if subject(reloader) != "first" {
+		t.Fatalf("Unexpected certificate %s", subject(reloader))
+	}
+
+	// a half written pair fails to load and keeps the current certificate
+	_, certPem, keyPem = selfSignedCertificate(t, "second")
+	modTime := time.Now()
+	write(certPem[:len(certPem)/2], keyPem, modTime)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Half written certificate loaded")
+			}
+		}()
+		reloader.Reload()
+	}()
+	if subject(reloader) != "first" {
+		t.Fatalf("Certificate replaced by a failed reload")
+	}
+
+	// completed within the same modification time, it is still retried
+	write(certPem, keyPem, modTime)
+	reloader.Reload()
+	if subject(reloader) != "second" {
+		t.Fatalf("Completed certificate not reloaded, got %s", subject(reloader))
+	}
+}
+
+func TestCertificateReloaderMissingFiles(t *testing.T) {
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Reloader created without certificate")
+		}
+	}()
+	web.NewCertificateReloader(web.TlsConfig{CertFile: &certFile, KeyFile: &keyFile}).Stop()
+}
+
+func TestClientCertificate(t *testing.T) {
+	certificate, _, _ := selfSignedCertificate(t, "client")
+	var received string
+	handler := web.InterceptClientCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = web.ClientCertificateSubject(r)
+	}))
+	cases := []struct {
+		state    *tls.ConnectionState
+		expected string
+	}{
+		{nil, ""},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}, ""},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}, VerifiedChains: [][]*x509.Certificate{{certificate}}}, "CN=client"},
+	}
+	for i, c := range cases {
+		received = ""
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = c.state
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if received != c.expected {
+			t.Fatalf("Case %d: unexpected subject %q, expected %q", i, received, c.expected)
+		}
+	}
+}
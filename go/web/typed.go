@@ -0,0 +1,113 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/tx"
+)
+
+// NoBody the In type of typed handlers that take no request body
+type NoBody struct{}
+
+func (o *Route) Describe(summary string, description string) *Route {
+	o.Summary = summary
+	o.Description = description
+	return o
+}
+
+func (o *Route) Tag(tags ...string) *Route {
+	o.Tags = append(o.Tags, tags...)
+	return o
+}
+
+func (o *Route) Hide() *Route {
+	o.Hidden = true
+	return o
+}
+
+// Accepts documents the request body, example is any value of the body type
+func (o *Route) Accepts(example interface{}) *Route {
+	o.Request = reflect.TypeOf(example)
+	return o
+}
+
+// Returns documents the response body for status, nil example for responses without body
+func (o *Route) Returns(status int, example interface{}) *Route {
+	if o.Responses == nil {
+		o.Responses = make(map[int]reflect.Type)
+	}
+	o.Responses[status] = reflect.TypeOf(example)
+	return o
+}
+
+func (o *Route) types(in reflect.Type, out reflect.Type) *Route {
+	if in != reflect.TypeOf(NoBody{}) {
+		o.Request = in
+	}
+	if o.Responses == nil {
+		o.Responses = make(map[int]reflect.Type)
+	}
+	o.Responses[http.StatusOK] = out
+	return o
+}
+
+// decodeTyped parses and validates the body, missing required fields are a 400
+func decodeTyped[In any](r *http.Request) *In {
+	in := new(In)
+	if _, ok := any(in).(*NoBody); ok {
+		return in
+	}
+	ParseParamOrBody(r, in)
+	if reflect.TypeOf(in).Elem().Kind() == reflect.Struct {
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					ThrowHttpError(http.StatusBadRequest, "%s", fmt.Sprint(e))
+				}
+			}()
+			ValidateStruct(in)
+		}()
+	}
+	return in
+}
+
+// TypedHandler decodes and validates In, the result is written in the negotiated format
+func TypedHandler[In any, Out any](f func(r *http.Request, in *In) Out) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		NegotiatedResponse(f(r, decodeTyped[In](r)), w, r)
+	}
+}
+
+func TypedTransactionalHandler[In any, Out any](f func(trx *tx.Transaction, r *http.Request, in *In) Out) func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request) {
+	return func(trx *tx.Transaction, w http.ResponseWriter, r *http.Request) {
+		NegotiatedResponse(f(trx, r, decodeTyped[In](r)), w, r)
+	}
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+func HandleTyped[In any, Out any](router *Router, method string, path string, f func(r *http.Request, in *In) Out) *Route {
+	return router.Handle(method, path, TypedHandler(f)).types(typeOf[In](), typeOf[Out]())
+}
+
+func HandleTypedTransactional[In any, Out any](router *Router, method string, path string, databaseConfig sql.DatasourceConfig, f func(trx *tx.Transaction, r *http.Request, in *In) Out) *Route {
+	return router.HandleTransactional(method, path, databaseConfig, TypedTransactionalHandler(f)).types(typeOf[In](), typeOf[Out]())
+}
+
+func HandleTypedAuthenticated[In any, Out any](router *Router, method string, path string, sessionManager *auth.SessionManager, f func(r *http.Request, in *In) Out) *Route {
+	return router.HandleAuthenticated(method, path, sessionManager, TypedHandler(f)).types(typeOf[In](), typeOf[Out]())
+}
+
+func HandleTypedAuthenticatedTransactional[In any, Out any](router *Router, method string, path string, sessionManager *auth.SessionManager, databaseConfig sql.DatasourceConfig, f func(trx *tx.Transaction, r *http.Request, in *In) Out) *Route {
+	return router.HandleAuthenticatedTransactional(method, path, sessionManager, databaseConfig, TypedTransactionalHandler(f)).types(typeOf[In](), typeOf[Out]())
+}
+
+func HandleTypedSigned[In any, Out any](router *Router, method string, path string, verifier *SignatureVerifier, f func(r *http.Request, in *In) Out) *Route {
+	return router.HandleSigned(method, path, verifier, TypedHandler(f)).types(typeOf[In](), typeOf[Out]())
+}
@@ -0,0 +1,264 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	ContentTypeMultipartFormData = "multipart/form-data"
+	sniffLength                  = 512
+)
+
+// UploadConfig MaxTotalSize limits the whole request body, MaxFieldsSize the non file fields together.
+// ContentTypes is the allowlist of sniffed content types, "image/*" matches any image, empty allows any.
+type UploadConfig struct {
+	Dir           *string  `json:"dir"`
+	MaxFileSize   *int64   `json:"maxFileSize"`
+	MaxTotalSize  *int64   `json:"maxTotalSize"`
+	MaxFiles      *int     `json:"maxFiles"`
+	MaxFieldsSize *int64   `json:"maxFieldsSize"`
+	ContentTypes  []string `json:"contentTypes"`
+}
+
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		Dir:           util.PStr(os.TempDir()),
+		MaxFileSize:   util.PInt64(32 * 1024 * 1024),
+		MaxTotalSize:  util.PInt64(100 * 1024 * 1024),
+		MaxFiles:      util.PInt(10),
+		MaxFieldsSize: util.PInt64(1024 * 1024),
+	}
+}
+
+func (o *UploadConfig) Validate() {
+	if o.Dir == nil || *o.Dir == "" {
+		panic("Invalid dir")
+	}
+	if o.MaxFileSize == nil || *o.MaxFileSize <= 0 {
+		panic("Invalid maxFileSize")
+	}
+	if o.MaxTotalSize == nil || *o.MaxTotalSize <= 0 {
+		panic("Invalid maxTotalSize")
+	}
+	if o.MaxFiles == nil || *o.MaxFiles <= 0 {
+		panic("Invalid maxFiles")
+	}
+	if o.MaxFieldsSize == nil || *o.MaxFieldsSize <= 0 {
+		panic("Invalid maxFieldsSize")
+	}
+}
+
+func (o *UploadConfig) allows(contentType string) bool {
+	if len(o.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range o.ContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadedFile FileName is the base name sent by the client, never used to build Path. ContentType is sniffed
+// from the content, the one declared by the client is ignored. Path is empty for files streamed to a caller writer.
+type UploadedFile struct {
+	FieldName   string
+	FileName    string
+	ContentType string
+	Size        int64
+	Sha256      string
+	Path        string
+}
+
+type Upload struct {
+	Fields url.Values
+	Files  []*UploadedFile
+	dir    string
+}
+
+// File the first file sent in fieldName, nil if none
+func (o *Upload) File(fieldName string) *UploadedFile {
+	for _, f := range o.Files {
+		if f.FieldName == fieldName {
+			return f
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the temp directory holding the files, files that must be kept have to be moved out first
+func (o *Upload) Cleanup() {
+	if o.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(o.dir); err != nil {
+		util.Log("warning").Printf("Could not remove upload dir %s: %v", o.dir, err)
+	}
+	o.dir = ""
+}
+
+// uploadBody limits the request body, exceeded tells a truncated body apart from a malformed one
+type uploadBody struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (o *uploadBody) Read(p []byte) (int, error) {
+	if o.remaining <= 0 {
+		o.exceeded = true
+		return 0, errors.New("request body too large")
+	}
+	if int64(len(p)) > o.remaining {
+		p = p[:o.remaining]
+	}
+	n, err := o.reader.Read(p)
+	o.remaining -= int64(n)
+	return n, err
+}
+
+func (o *uploadBody) check(err error, message string) {
+	if err == nil {
+		return
+	}
+	if o.exceeded {
+		ThrowHttpError(http.StatusRequestEntityTooLarge, "Request body larger than the limit")
+	}
+	ThrowHttpError(http.StatusBadRequest, "%s: %v", message, err)
+}
+
+// uploadWriter keeps the destination errors apart, they are server errors rather than bad requests
+type uploadWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (o *uploadWriter) Write(p []byte) (int, error) {
+	n, err := o.writer.Write(p)
+	if err != nil {
+		o.err = err
+	}
+	return n, err
+}
+
+func multipartReader(r *http.Request, body *uploadBody) *multipart.Reader {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+	if err != nil || mediaType != ContentTypeMultipartFormData {
+		ThrowHttpError(http.StatusUnsupportedMediaType, "Unsupported content type %q", r.Header.Get(HeaderContentType))
+	}
+	if params["boundary"] == "" {
+		ThrowHttpError(http.StatusBadRequest, "Missing multipart boundary")
+	}
+	return multipart.NewReader(body, params["boundary"])
+}
+
+// ParseUpload streams the files into a new temp directory under config.Dir. The caller must defer
+// upload.Cleanup(), on panic the files written so far are removed before the panic goes on.
+func ParseUpload(r *http.Request, config UploadConfig) *Upload {
+	config.Validate()
+	dir, err := os.MkdirTemp(*config.Dir, "upload-")
+	util.CheckErr(err)
+	upload := &Upload{dir: dir}
+	defer func() {
+		if e := recover(); e != nil {
+			upload.Cleanup()
+			panic(e)
+		}
+	}()
+	parseUpload(r, config, upload, func(file *UploadedFile) io.Writer {
+		f, err := os.CreateTemp(dir, "file-")
+		util.CheckErr(err)
+		file.Path = f.Name()
+		return f
+	})
+	return upload
+}
+
+// ParseUploadTo streams each file to the writer returned by open, which is called once the content type
+// has been sniffed and accepted. Writers implementing io.Closer are closed after their part, cleaning up
+// what was written before a panic is up to the caller.
+func ParseUploadTo(r *http.Request, config UploadConfig, open func(file *UploadedFile) io.Writer) *Upload {
+	config.Validate()
+	upload := &Upload{}
+	parseUpload(r, config, upload, open)
+	return upload
+}
+
+func parseUpload(r *http.Request, config UploadConfig, upload *Upload, open func(file *UploadedFile) io.Writer) {
+	body := &uploadBody{reader: r.Body, remaining: *config.MaxTotalSize + 1}
+	reader := multipartReader(r, body)
+	upload.Fields = make(url.Values)
+	fieldsSize := int64(0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		body.check(err, "Invalid multipart body")
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, *config.MaxFieldsSize-fieldsSize+1))
+			body.check(err, "Invalid multipart field")
+			fieldsSize += int64(len(value))
+			if fieldsSize > *config.MaxFieldsSize {
+				ThrowHttpError(http.StatusRequestEntityTooLarge, "Form fields larger than %d bytes", *config.MaxFieldsSize)
+			}
+			upload.Fields.Add(part.FormName(), string(value))
+			continue
+		}
+		if len(upload.Files) == *config.MaxFiles {
+			ThrowHttpError(http.StatusRequestEntityTooLarge, "More than %d files", *config.MaxFiles)
+		}
+		upload.Files = append(upload.Files, receiveFile(part, config, body, open))
+	}
+}
+
+// receiveFile sniffs the first bytes, then copies the part hashing it on the way
+func receiveFile(part *multipart.Part, config UploadConfig, body *uploadBody, open func(file *UploadedFile) io.Writer) *UploadedFile {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(part, head)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		body.check(err, "Invalid multipart file")
+	}
+	head = head[:n]
+	file := &UploadedFile{FieldName: part.FormName(), FileName: part.FileName(), ContentType: http.DetectContentType(head)}
+	if !config.allows(file.ContentType) {
+		ThrowHttpError(http.StatusUnsupportedMediaType, "Unsupported file type %s for %s", file.ContentType, file.FileName)
+	}
+	w := open(file)
+	if closer, ok := w.(io.Closer); ok {
+		defer func() {
+			util.CheckErr(closer.Close())
+		}()
+	}
+	hash := sha256.New()
+	destination := &uploadWriter{writer: w}
+	source := io.MultiReader(bytes.NewReader(head), io.LimitReader(part, *config.MaxFileSize-int64(len(head))+1))
+	file.Size, err = io.Copy(io.MultiWriter(destination, hash), source)
+	util.CheckErr(destination.err)
+	body.check(err, "Invalid multipart file")
+	if file.Size > *config.MaxFileSize {
+		ThrowHttpError(http.StatusRequestEntityTooLarge, "File %s larger than %d bytes", file.FileName, *config.MaxFileSize)
+	}
+	file.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return file
+}
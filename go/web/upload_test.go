@@ -0,0 +1,94 @@
+package web_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sparrowhawktech/toolkit/util"
+	"sparrowhawktech/toolkit/web"
+	"testing"
+)
+
+func multipartRequest(t *testing.T, url string, fields map[string]string, files map[string][]byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		util.CheckErr(writer.WriteField(k, v))
+	}
+	for name, content := range files {
+		w, err := writer.CreateFormFile("file", name)
+		util.CheckErr(err)
+		_, err = w.Write(content)
+		util.CheckErr(err)
+	}
+	util.CheckErr(writer.Close())
+	request, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(web.HeaderContentType, writer.FormDataContentType())
+	return request
+}
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	config := web.DefaultUploadConfig()
+	config.Dir = &dir
+	config.MaxFileSize = util.PInt64(1024)
+	config.ContentTypes = []string{"image/*", "text/plain"}
+	var received *web.UploadedFile
+	var content []byte
+	mux := http.NewServeMux()
+	web.HandleDefault(mux, "/upload", func(w http.ResponseWriter, r *http.Request) {
+		upload := web.ParseUpload(r, config)
+		defer upload.Cleanup()
+		if upload.Fields.Get("title") != "notes" {
+			panic("Missing title")
+		}
+		received = upload.File("file")
+		var err error
+		content, err = os.ReadFile(received.Path)
+		util.CheckErr(err)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	text := []byte("plain text content")
+	response, err := http.DefaultClient.Do(multipartRequest(t, server.URL+"/upload", map[string]string{"title": "notes"}, map[string][]byte{"../notes.txt": text}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	sum := sha256.Sum256(text)
+	if response.StatusCode != http.StatusOK || received == nil || received.FileName != "notes.txt" || received.Size != int64(len(text)) ||
+		received.Sha256 != hex.EncodeToString(sum[:]) || received.ContentType != "text/plain; charset=utf-8" || !bytes.Equal(content, text) {
+		t.Fatalf("Unexpected upload %d %+v", response.StatusCode, received)
+	}
+
+	cases := []struct {
+		content []byte
+		status  int
+	}{
+		{bytes.Repeat([]byte("a"), 2048), http.StatusRequestEntityTooLarge},
+		{[]byte("%PDF-1.4 document"), http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		response, err := http.DefaultClient.Do(multipartRequest(t, server.URL+"/upload", nil, map[string][]byte{"f": c.content}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != c.status {
+			t.Fatalf("Unexpected status %d, expected %d", response.StatusCode, c.status)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	util.CheckErr(err)
+	if len(entries) != 0 {
+		t.Fatalf("Upload dirs left behind: %v", entries)
+	}
+}
@@ -1,13 +1,13 @@
 package web
 
 import (
-	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,12 +24,15 @@ import (
 const (
 	HeaderContentType          = "Content-Type"
 	HeaderAuthorization        = "Authorization"
+	HeaderRetryAfter           = "Retry-After"
+	HeaderIdempotencyKey       = "Idempotency-Key"
 	ContentTypeApplicationJson = "application/json"
 	ContentTypeOctetStream     = "octet/stream"
 	ClientIdHeaderName         = "Toolkit-ClientId"
 	TimestampHeaderName        = "Toolkit-Timestamp"
 	SignatureHeaderName        = "Toolkit-Signature"
 	ErrorHeaderName            = "Toolkit-Error"
+	CorrelationIdHeaderName    = "Toolkit-Correlation-Id"
 )
 
 type FriendlyErrorResponse = util.FriendlyErrorMessage
@@ -63,12 +66,34 @@ func JsonResponsePretty(i interface{}, w http.ResponseWriter) {
 func interceptDebug(delegate func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if util.Loggable("debug") {
-			util.Log("debug").Printf("Handling %s from %s", r.URL.String(), r.RemoteAddr)
+			util.Log("debug").Printf("Handling %s from %s", r.URL.String(), ResolveClientIP(r))
 		}
 		delegate(w, r)
 	}
 }
 
+// ResolveClientIP the peer address, or the forwarded client address when the peer is a trusted proxy,
+// see ConfigureTrustedProxies
+func ResolveClientIP(r *http.Request) string {
+	if addr, ok := resolveClientAddr(r); ok {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// routeKey resolves the pattern the request was routed with, falling back to the path for
+// handlers invoked outside a mux
+func routeKey(r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
+
 func HandleDefault(serveMux *http.ServeMux, path string, f func(w http.ResponseWriter, r *http.Request)) {
 	if serveMux == nil {
 		serveMux = http.DefaultServeMux
@@ -178,7 +203,7 @@ func ListenAndWait(serveMux *http.ServeMux, port int) *http.Server {
 		if n > 10 {
 			panic("Mock services http server is not responding")
 		}
-		_, err := client.Get(fmt.Sprintf("http://localhost:%d/ping", port))
+		_, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, HealthLivePath))
 		if err == nil {
 			break
 		} else {
@@ -191,69 +216,39 @@ func ListenAndWait(serveMux *http.ServeMux, port int) *http.Server {
 }
 
 func JsonRequest(method string, url string, out interface{}, in interface{}, timeout time.Duration, maxResult int) {
-	buffer := &bytes.Buffer{}
-	if out != nil {
-		util.JsonEncode(out, buffer)
-	}
-	request, err := http.NewRequest(method, url, buffer)
-	util.CheckErr(err)
-	request.Header.Set(HeaderContentType, ContentTypeApplicationJson)
-	config := &tls.Config{}
-	transport := &http.Transport{TLSClientConfig: config}
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   timeout,
-	}
-	response, err := client.Do(request)
-	util.CheckErr(err)
-	defer CloseResponse(response)
-	CheckResponse(response, maxResult)
-	if in != nil {
-		util.JsonDecode(in, response.Body)
-	}
+	JsonRequestContext(context.Background(), method, url, out, in, timeout, maxResult)
+}
+
+// JsonRequestContext same as JsonRequest, forwarding the correlation id found in ctx
+func JsonRequestContext(ctx context.Context, method string, url string, out interface{}, in interface{}, timeout time.Duration, maxResult int) {
+	defaultClient.WithTimeout(timeout).JsonRequest(ctx, method, url, out, in, maxResult, nil)
 }
 
 func GetJson(url string, timeout time.Duration, maxResult int, headers map[string]string, entity interface{}) {
-	response := requestGet(url, timeout, headers)
+	GetJsonContext(context.Background(), url, timeout, maxResult, headers, entity)
+}
+
+func GetJsonContext(ctx context.Context, url string, timeout time.Duration, maxResult int, headers map[string]string, entity interface{}) {
+	response := defaultClient.WithTimeout(timeout).Do(ctx, http.MethodGet, url, nil, headers)
 	defer CloseResponse(response)
 	CheckResponse(response, maxResult)
 	util.JsonDecode(entity, response.Body)
 }
 
 func Get(url string, timeout time.Duration, maxResult int, headers map[string]string) []byte {
-	response := requestGet(url, timeout, headers)
-	defer CloseResponse(response)
-	CheckResponse(response, maxResult)
-	result := &bytes.Buffer{}
-	_, err := io.Copy(result, response.Body)
-	util.CheckErr(err)
-	return result.Bytes()
+	return GetContext(context.Background(), url, timeout, maxResult, headers)
+}
+
+func GetContext(ctx context.Context, url string, timeout time.Duration, maxResult int, headers map[string]string) []byte {
+	return defaultClient.WithTimeout(timeout).Get(ctx, url, maxResult, headers)
 }
 
 func GetStream(url string, timeout time.Duration, maxResult int, headers map[string]string, w io.Writer) {
-	response := requestGet(url, timeout, headers)
-	defer CloseResponse(response)
-	CheckResponse(response, maxResult)
-	_, err := io.Copy(w, response.Body)
-	util.CheckErr(err)
+	GetStreamContext(context.Background(), url, timeout, maxResult, headers, w)
 }
 
-func requestGet(url string, timeout time.Duration, headers map[string]string) *http.Response {
-	buffer := &bytes.Buffer{}
-	request, err := http.NewRequest("GET", url, buffer)
-	util.CheckErr(err)
-	for k, v := range headers {
-		request.Header.Add(k, v)
-	}
-	config := &tls.Config{}
-	transport := &http.Transport{TLSClientConfig: config}
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   timeout,
-	}
-	response, err := client.Do(request)
-	util.CheckErr(err)
-	return response
+func GetStreamContext(ctx context.Context, url string, timeout time.Duration, maxResult int, headers map[string]string, w io.Writer) {
+	defaultClient.WithTimeout(timeout).GetStream(ctx, url, maxResult, headers, w)
 }
 
 func CreateSignature(secret string, data []byte) string {
@@ -272,55 +267,28 @@ func ConfigureHandlerSignedTransactional(serveMux *http.ServeMux, path string, s
 }
 
 func PostJson(url string, out interface{}, in interface{}, maxResult int, timeout time.Duration, headers map[string]string) {
-	buffer := &bytes.Buffer{}
-	if out != nil {
-		util.JsonEncode(out, buffer)
-	}
-	request, err := http.NewRequest("POST", url, buffer)
-	util.CheckErr(err)
-	request.Close = true
-	request.Header.Set(HeaderContentType, "application/json")
-	for k, v := range headers {
-		request.Header.Set(k, v)
-	}
+	PostJsonContext(context.Background(), url, out, in, maxResult, timeout, headers)
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{},
-		Timeout:   timeout,
-	}
-	response, err := client.Do(request)
-	util.CheckErr(err)
-	defer CloseResponse(response)
-	CheckResponse(response, maxResult)
-	if in != nil {
-		util.JsonDecode(in, response.Body)
-	}
+// PostJsonContext same as PostJson, forwarding the correlation id found in ctx
+func PostJsonContext(ctx context.Context, url string, out interface{}, in interface{}, maxResult int, timeout time.Duration, headers map[string]string) {
+	defaultClient.WithTimeout(timeout).PostJson(ctx, url, out, in, maxResult, headers)
 }
 
 func PostJsonSigned(url string, out interface{}, in interface{}, maxResult int, timeout time.Duration, clientId string, clientSecret string) {
-	timestamp := time.Now().Format(time.RFC3339)
-	signature := CreateSignature(clientSecret, []byte(clientId+"."+timestamp))
-	PostJson(url, out, in, maxResult, timeout, map[string]string{ClientIdHeaderName: clientId, TimestampHeaderName: timestamp, SignatureHeaderName: signature})
+	PostJsonSignedContext(context.Background(), url, out, in, maxResult, timeout, clientId, clientSecret)
+}
+
+func PostJsonSignedContext(ctx context.Context, url string, out interface{}, in interface{}, maxResult int, timeout time.Duration, clientId string, clientSecret string) {
+	defaultClient.WithTimeout(timeout).WithAuth(SignedAuth{ClientId: clientId, Secret: clientSecret}).PostJson(ctx, url, out, in, maxResult, nil)
 }
 
 func Request(method string, url string, out io.Reader, in io.Writer, maxResult int, timeout time.Duration, headers map[string]string) {
-	request, err := http.NewRequest(method, url, out)
-	util.CheckErr(err)
-	request.Close = true
-	for k, v := range headers {
-		request.Header.Set(k, v)
-	}
-	client := &http.Client{
-		Timeout: timeout,
-	}
-	response, err := client.Do(request)
-	util.CheckErr(err)
-	defer CloseResponse(response)
-	CheckResponse(response, maxResult)
-	if in != nil {
-		_, err = io.Copy(in, response.Body)
-		util.CheckErr(err)
-	}
+	RequestContext(context.Background(), method, url, out, in, maxResult, timeout, headers)
+}
+
+func RequestContext(ctx context.Context, method string, url string, out io.Reader, in io.Writer, maxResult int, timeout time.Duration, headers map[string]string) {
+	defaultClient.WithTimeout(timeout).Request(ctx, method, url, out, in, maxResult, headers)
 }
 
 // ValidateStruct Assumes all members are pointers and recursivly evaluates assigment only and only if
@@ -1,22 +1,58 @@
 package web
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
 	"sparrowhawktech/toolkit/util"
 	"strings"
 )
 
+// HttpError panicking with it renders StatusCode and Error (as friendly message when it is a string) in catchFatal
 type HttpError struct {
 	StatusCode int
 	Error      interface{}
 }
 
+func ThrowHttpError(statusCode int, message string, args ...any) {
+	panic(HttpError{StatusCode: statusCode, Error: util.FriendlyErrorMessage{ErrorMessage: fmt.Sprintf(message, args...)}})
+}
+
+// asHttpError besides HttpError, body size limits hit through http.MaxBytesReader map to 413
+func asHttpError(e interface{}) (HttpError, bool) {
+	switch v := e.(type) {
+	case HttpError:
+		return v, true
+	case *HttpError:
+		return *v, true
+	case error:
+		var maxBytesError *http.MaxBytesError
+		if errors.As(v, &maxBytesError) {
+			return HttpError{StatusCode: http.StatusRequestEntityTooLarge,
+				Error: util.FriendlyErrorMessage{ErrorMessage: fmt.Sprintf("Request body exceeds %d bytes", maxBytesError.Limit)}}, true
+		}
+	}
+	return HttpError{}, false
+}
+
+// ParseParamOrBody decodes the body query parameter as json, or the body as xml or json depending on its content type
 func ParseParamOrBody(r *http.Request, o interface{}) {
+	ParseParamOrBodyWith(r, o, decoding)
+}
+
+func ParseParamOrBodyWith(r *http.Request, o interface{}, config DecodeConfig) {
 	s := r.URL.Query().Get("body")
 	if len(s) > 0 {
-		util.CheckErr(json.NewDecoder(strings.NewReader(s)).Decode(o))
+		decodeJson(strings.NewReader(s), o, config)
 	} else {
-		util.CheckErr(json.NewDecoder(r.Body).Decode(o))
+		checkContentType(r, config)
+		reader := http.MaxBytesReader(nil, r.Body, *config.MaxBytes)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get(HeaderContentType))
+		if isXmlContentType(mediaType) {
+			decodeXml(reader, o, config)
+		} else {
+			decodeJson(reader, o, config)
+		}
 	}
 }
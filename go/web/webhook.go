@@ -0,0 +1,423 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sparrowhawktech/toolkit/sql"
+	"sparrowhawktech/toolkit/tx"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	WebhookIdHeaderName      = "Toolkit-Webhook-Id"
+	WebhookEventHeaderName   = "Toolkit-Webhook-Event"
+	WebhookAttemptHeaderName = "Toolkit-Webhook-Attempt"
+
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+
+	maxWebhookResponse = 4 * 1024
+	webhookTableSql    = `create table if not exists %s (
+	id bigserial primary key,
+	endpoint text not null,
+	event text not null,
+	payload text not null,
+	status text not null default 'pending',
+	attempts integer not null default 0,
+	next_attempt timestamptz not null default now(),
+	locked_until timestamptz,
+	last_error text,
+	created timestamptz not null default now(),
+	delivered timestamptz
+)`
+	webhookIndexSql   = "create index if not exists %s_pending on %s (endpoint, next_attempt) where status = 'pending'"
+	webhookAttemptSql = `create table if not exists %[1]s_attempt (
+	id bigserial primary key,
+	webhook_id bigint not null references %[1]s (id) on delete cascade,
+	attempt integer not null,
+	started timestamptz not null,
+	duration_ms double precision not null,
+	status integer,
+	response text,
+	error text
+)`
+	webhookAttemptIndexSql = "create index if not exists %s_attempt_webhook on %s_attempt (webhook_id)"
+)
+
+// WebhookConfig PollInterval, InitialBackoff, MaxBackoff, Timeout and LockTimeout are in seconds. LockTimeout is
+// how long a claimed delivery waits before another dispatcher picks it up again, i.e. the process died, so it
+// must be longer than Timeout. Deliveries failing MaxAttempts times are dead lettered.
+type WebhookConfig struct {
+	Table          *string `json:"table"`
+	PollInterval   *int    `json:"pollInterval"`
+	BatchSize      *int    `json:"batchSize"`
+	MaxAttempts    *int    `json:"maxAttempts"`
+	InitialBackoff *int    `json:"initialBackoff"`
+	MaxBackoff     *int    `json:"maxBackoff"`
+	Timeout        *int    `json:"timeout"`
+	LockTimeout    *int    `json:"lockTimeout"`
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Table:          util.PStr("webhook"),
+		PollInterval:   util.PInt(5),
+		BatchSize:      util.PInt(100),
+		MaxAttempts:    util.PInt(10),
+		InitialBackoff: util.PInt(10),
+		MaxBackoff:     util.PInt(60 * 60),
+		Timeout:        util.PInt(30),
+		LockTimeout:    util.PInt(5 * 60),
+	}
+}
+
+func (o *WebhookConfig) Validate() {
+	if o.Table == nil || !tableNameRegexp.MatchString(*o.Table) {
+		panic("Invalid table")
+	}
+	if o.PollInterval == nil || *o.PollInterval <= 0 {
+		panic("Invalid pollInterval")
+	}
+	if o.BatchSize == nil || *o.BatchSize <= 0 {
+		panic("Invalid batchSize")
+	}
+	if o.MaxAttempts == nil || *o.MaxAttempts <= 0 {
+		panic("Invalid maxAttempts")
+	}
+	if o.InitialBackoff == nil || *o.InitialBackoff <= 0 {
+		panic("Invalid initialBackoff")
+	}
+	if o.MaxBackoff == nil || *o.MaxBackoff < *o.InitialBackoff {
+		panic("Invalid maxBackoff")
+	}
+	if o.Timeout == nil || *o.Timeout <= 0 {
+		panic("Invalid timeout")
+	}
+	if o.LockTimeout == nil || *o.LockTimeout <= *o.Timeout {
+		panic("Invalid lockTimeout")
+	}
+}
+
+// WebhookEndpoint deliveries are posted to Url with version 2 signatures made with ClientId and Secret, so
+// receivers built on this toolkit verify them with InterceptSigned. Concurrency limits the deliveries in flight.
+type WebhookEndpoint struct {
+	Name        *string `json:"name"`
+	Url         *string `json:"url"`
+	ClientId    *string `json:"clientId"`
+	Secret      *string `json:"secret"`
+	Concurrency *int    `json:"concurrency"`
+}
+
+func (o *WebhookEndpoint) Validate() {
+	if o.Name == nil || *o.Name == "" {
+		panic("Invalid name")
+	}
+	if o.Url == nil || !(strings.HasPrefix(*o.Url, "http://") || strings.HasPrefix(*o.Url, "https://")) {
+		panic("Invalid url")
+	}
+	if o.ClientId == nil || *o.ClientId == "" {
+		panic("Invalid clientId")
+	}
+	if o.Secret == nil || *o.Secret == "" {
+		panic("Invalid secret")
+	}
+	if o.Concurrency == nil || *o.Concurrency <= 0 {
+		panic("Invalid concurrency")
+	}
+}
+
+// CreateWebhookTables creates the queue table and its <table>_attempt delivery log if they do not exist
+func CreateWebhookTables(trx *tx.Transaction, config WebhookConfig) {
+	config.Validate()
+	table := *config.Table
+	// index names cannot be schema qualified, they go to the schema of their table
+	name := table[strings.LastIndex(table, ".")+1:]
+	trx.Exec(fmt.Sprintf(webhookTableSql, table))
+	trx.Exec(fmt.Sprintf(webhookIndexSql, name, table))
+	trx.Exec(fmt.Sprintf(webhookAttemptSql, table))
+	trx.Exec(fmt.Sprintf(webhookAttemptIndexSql, name, table))
+}
+
+// RedeliverWebhook puts a dead lettered delivery back in the queue with its attempts reset
+func RedeliverWebhook(trx *tx.Transaction, config WebhookConfig, id int64) bool {
+	config.Validate()
+	result := trx.Exec(fmt.Sprintf(`update %s set status = 'pending', attempts = 0, next_attempt = now(), locked_until = null
+where id = $1 and status = 'dead'`, *config.Table), id)
+	n, err := (*result).RowsAffected()
+	util.CheckErr(err)
+	return n == 1
+}
+
+// PurgeWebhooks deletes the deliveries, and their log, delivered before olderThan
+func PurgeWebhooks(trx *tx.Transaction, config WebhookConfig, olderThan time.Time) {
+	config.Validate()
+	trx.Exec(fmt.Sprintf("delete from %s where status = 'delivered' and delivered < $1", *config.Table), olderThan)
+}
+
+type webhookEndpoint struct {
+	config WebhookEndpoint
+	client *Client
+	slots  chan struct{}
+}
+
+type webhookDelivery struct {
+	id       int64
+	event    string
+	payload  string
+	attempts int
+}
+
+// WebhookDispatcher delivers the queued events to their endpoints with at least once semantics, receivers
+// should use the Toolkit-Webhook-Id header to discard duplicates. Deliveries of an endpoint are not ordered
+// once Concurrency is above 1 or a delivery is retried. Several dispatchers, i.e. one per instance, can share
+// the queue. Events for endpoints not added to the dispatcher stay pending.
+type WebhookDispatcher struct {
+	datasourceConfig sql.DatasourceConfig
+	config           WebhookConfig
+	retry            *RetryPolicy
+	endpoints        map[string]*webhookEndpoint
+	mux              *sync.Mutex
+	wake             chan struct{}
+	done             chan struct{}
+	wg               *sync.WaitGroup
+	insertSql        string
+	claimSql         string
+	attemptSql       string
+	deliveredSql     string
+	retrySql         string
+	deadSql          string
+}
+
+func (o *WebhookDispatcher) AddEndpoint(endpoint WebhookEndpoint) {
+	endpoint.Validate()
+	client := NewClient("").WithTimeout(time.Duration(*o.config.Timeout) * time.Second).WithAuth(SignedAuth{ClientId: *endpoint.ClientId, Secret: *endpoint.Secret})
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if _, ok := o.endpoints[*endpoint.Name]; ok {
+		panic(fmt.Sprintf("Webhook endpoint %s already added", *endpoint.Name))
+	}
+	o.endpoints[*endpoint.Name] = &webhookEndpoint{config: endpoint, client: client, slots: make(chan struct{}, *endpoint.Concurrency)}
+}
+
+func (o *WebhookDispatcher) resolveEndpoint(name string) *webhookEndpoint {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	endpoint, ok := o.endpoints[name]
+	if !ok {
+		panic(fmt.Sprintf("Unknown webhook endpoint %s", name))
+	}
+	return endpoint
+}
+
+// Enqueue queues the event in trx so it is only delivered if trx commits, the dispatcher is woken up after the
+// commit. The payload is sent as json.
+func (o *WebhookDispatcher) Enqueue(trx *tx.Transaction, endpoint string, event string, payload interface{}) int64 {
+	o.resolveEndpoint(endpoint)
+	var id int64
+	trx.Singleton(o.insertSql, []interface{}{&id}, endpoint, event, string(util.Marshal(payload)))
+	trx.AddFuture(o.Wake)
+	return id
+}
+
+// Send queues the event in its own transaction
+func (o *WebhookDispatcher) Send(endpoint string, event string, payload interface{}) int64 {
+	return tx.Execute(o.datasourceConfig, func(trx *tx.Transaction, args ...interface{}) interface{} {
+		return o.Enqueue(trx, endpoint, event, payload)
+	}).(int64)
+}
+
+// EnqueueOnCommit queues the event through trx.AddFuture once trx commits, for transactions on a different
+// database than the queue. An event is lost if the process dies between the commit and the queueing.
+func (o *WebhookDispatcher) EnqueueOnCommit(trx *tx.Transaction, endpoint string, event string, payload interface{}) {
+	o.resolveEndpoint(endpoint)
+	trx.AddFuture(func() {
+		o.Send(endpoint, event, payload)
+	})
+}
+
+// Wake makes the dispatcher look for pending deliveries without waiting for PollInterval
+func (o *WebhookDispatcher) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *WebhookDispatcher) Start() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.done != nil {
+		return
+	}
+	done := make(chan struct{})
+	o.done = done
+	o.wg.Add(1)
+	go o.run(done)
+	util.Log("web").Println("Webhook dispatcher started")
+}
+
+// Stop waits for the deliveries in flight, at most Timeout
+func (o *WebhookDispatcher) Stop() {
+	o.mux.Lock()
+	if o.done == nil {
+		o.mux.Unlock()
+		return
+	}
+	close(o.done)
+	o.done = nil
+	o.mux.Unlock()
+	o.wg.Wait()
+	util.Log("web").Println("Webhook dispatcher stopped")
+}
+
+func (o *WebhookDispatcher) run(done chan struct{}) {
+	defer o.wg.Done()
+	ticker := time.NewTicker(time.Duration(*o.config.PollInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		o.safeDispatch(done)
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (o *WebhookDispatcher) safeDispatch(done chan struct{}) {
+	defer util.CatchPanic()
+	o.mux.Lock()
+	endpoints := make([]*webhookEndpoint, 0, len(o.endpoints))
+	for _, endpoint := range o.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	o.mux.Unlock()
+	for _, endpoint := range endpoints {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		// slots are only taken here so the free ones cannot go away before the deliveries start
+		free := min(cap(endpoint.slots)-len(endpoint.slots), *o.config.BatchSize)
+		if free == 0 {
+			continue
+		}
+		for _, delivery := range o.claim(*endpoint.config.Name, free) {
+			endpoint.slots <- struct{}{}
+			o.wg.Add(1)
+			go o.deliver(endpoint, delivery)
+		}
+	}
+}
+
+// claim locks the due deliveries for LockTimeout and counts the attempt, so a process dying while delivering
+// still uses it up
+func (o *WebhookDispatcher) claim(endpoint string, limit int) []*webhookDelivery {
+	return tx.Execute(o.datasourceConfig, func(trx *tx.Transaction, args ...interface{}) interface{} {
+		rows := trx.Query(o.claimSql, endpoint, limit, *o.config.LockTimeout)
+		defer rows.Close()
+		result := make([]*webhookDelivery, 0)
+		for rows.Next() {
+			delivery := &webhookDelivery{}
+			util.CheckErr(rows.Scan(&delivery.id, &delivery.event, &delivery.payload, &delivery.attempts))
+			result = append(result, delivery)
+		}
+		util.CheckErr(rows.Err())
+		return result
+	}).([]*webhookDelivery)
+}
+
+func (o *WebhookDispatcher) deliver(endpoint *webhookEndpoint, delivery *webhookDelivery) {
+	defer o.wg.Done()
+	defer func() { <-endpoint.slots }()
+	defer util.CatchPanic()
+	started := time.Now()
+	status, retryAfter, response, message := o.post(endpoint, delivery)
+	duration := float64(time.Since(started).Microseconds()) / 1000
+	tx.Execute(o.datasourceConfig, func(trx *tx.Transaction, args ...interface{}) interface{} {
+		trx.Exec(o.attemptSql, delivery.id, delivery.attempts, started, duration, status, response, message)
+		if message == "" {
+			trx.Exec(o.deliveredSql, delivery.id)
+		} else if delivery.attempts >= *o.config.MaxAttempts {
+			trx.Exec(o.deadSql, delivery.id, message)
+			util.Log("error").Printf("Webhook %d %s to %s dead lettered after %d attempts: %s", delivery.id, delivery.event, *endpoint.config.Name, delivery.attempts, message)
+		} else {
+			wait := max(o.retry.backoff(delivery.attempts), min(retryAfter, o.retry.MaxBackoff))
+			trx.Exec(o.retrySql, delivery.id, message, wait.Milliseconds())
+			util.Log("warning").Printf("Webhook %d %s to %s failed, retrying in %v: %s", delivery.id, delivery.event, *endpoint.config.Name, wait, message)
+		}
+		return nil
+	})
+}
+
+// post any non 2xx status is a failure, the start of the response body is kept in the delivery log
+func (o *WebhookDispatcher) post(endpoint *webhookEndpoint, delivery *webhookDelivery) (status *int, retryAfter time.Duration, response *string, message string) {
+	defer func() {
+		if e := recover(); e != nil {
+			message = fmt.Sprint(e)
+		}
+	}()
+	headers := map[string]string{
+		HeaderContentType:        ContentTypeApplicationJson,
+		WebhookIdHeaderName:      strconv.FormatInt(delivery.id, 10),
+		WebhookEventHeaderName:   delivery.event,
+		WebhookAttemptHeaderName: strconv.Itoa(delivery.attempts),
+	}
+	r := endpoint.client.Do(context.Background(), http.MethodPost, *endpoint.config.Url, bytes.NewReader([]byte(delivery.payload)), headers)
+	defer CloseResponse(r)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookResponse))
+	if err != nil {
+		util.Log("warning").Printf("Could not read webhook %d response: %v", delivery.id, err)
+	}
+	status = &r.StatusCode
+	response = util.PStr(strings.ToValidUTF8(string(body), "?"))
+	if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusMultipleChoices {
+		message = fmt.Sprintf("Status %d", r.StatusCode)
+		if seconds, e := strconv.Atoi(r.Header.Get(HeaderRetryAfter)); e == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	return
+}
+
+// NewWebhookDispatcher the queue lives in the database of datasourceConfig, see CreateWebhookTables
+func NewWebhookDispatcher(datasourceConfig sql.DatasourceConfig, config WebhookConfig) *WebhookDispatcher {
+	config.Validate()
+	table := *config.Table
+	return &WebhookDispatcher{
+		datasourceConfig: datasourceConfig,
+		config:           config,
+		retry: &RetryPolicy{
+			MaxAttempts:    *config.MaxAttempts,
+			InitialBackoff: time.Duration(*config.InitialBackoff) * time.Second,
+			MaxBackoff:     time.Duration(*config.MaxBackoff) * time.Second,
+			Multiplier:     2,
+		},
+		endpoints: make(map[string]*webhookEndpoint),
+		mux:       &sync.Mutex{},
+		wake:      make(chan struct{}, 1),
+		wg:        &sync.WaitGroup{},
+		insertSql: fmt.Sprintf("insert into %s (endpoint, event, payload) values ($1, $2, $3) returning id", table),
+		claimSql: fmt.Sprintf(`update %[1]s set attempts = attempts + 1, locked_until = now() + $3 * interval '1 second'
+where id in (select id from %[1]s where endpoint = $1 and status = 'pending' and next_attempt <= now()
+	and (locked_until is null or locked_until < now()) order by next_attempt, id limit $2 for update skip locked)
+returning id, event, payload, attempts`, table),
+		attemptSql: fmt.Sprintf(`insert into %s_attempt (webhook_id, attempt, started, duration_ms, status, response, error)
+values ($1, $2, $3, $4, $5, $6, nullif($7, ''))`, table),
+		deliveredSql: fmt.Sprintf("update %s set status = 'delivered', delivered = now(), locked_until = null, last_error = null where id = $1", table),
+		retrySql: fmt.Sprintf(`update %s set last_error = $2, next_attempt = now() + $3 * interval '1 millisecond', locked_until = null
+where id = $1`, table),
+		deadSql: fmt.Sprintf("update %s set status = 'dead', last_error = $2, locked_until = null where id = $1", table),
+	}
+}
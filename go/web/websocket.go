@@ -0,0 +1,682 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"sparrowhawktech/toolkit/auth"
+	"sparrowhawktech/toolkit/util"
+)
+
+const (
+	WebSocketText   = 1
+	WebSocketBinary = 2
+
+	wsContinuation = 0
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+
+	WebSocketNormalClosure   = 1000
+	WebSocketGoingAway       = 1001
+	WebSocketProtocolError   = 1002
+	WebSocketInvalidData     = 1007
+	WebSocketPolicyViolation = 1008
+	WebSocketMessageTooBig   = 1009
+	WebSocketInternalError   = 1011
+
+	webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocketConfig intervals in seconds. Origins lists the accepted Origin hosts, when empty only the
+// request host is accepted, "*" accepts any.
+type WebSocketConfig struct {
+	MaxMessageSize *int64   `json:"maxMessageSize"`
+	PingInterval   *int     `json:"pingInterval"`
+	PongTimeout    *int     `json:"pongTimeout"`
+	WriteTimeout   *int     `json:"writeTimeout"`
+	SendQueue      *int     `json:"sendQueue"`
+	Origins        []string `json:"origins"`
+	Subprotocols   []string `json:"subprotocols"`
+}
+
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		MaxMessageSize: util.PInt64(1024 * 1024),
+		PingInterval:   util.PInt(30),
+		PongTimeout:    util.PInt(10),
+		WriteTimeout:   util.PInt(10),
+		SendQueue:      util.PInt(64),
+	}
+}
+
+func (o *WebSocketConfig) Validate() {
+	if o.MaxMessageSize == nil || *o.MaxMessageSize < 1 {
+		panic("Invalid maxMessageSize")
+	}
+	if o.PingInterval == nil || *o.PingInterval < 1 {
+		panic("Invalid pingInterval")
+	}
+	if o.PongTimeout == nil || *o.PongTimeout < 1 {
+		panic("Invalid pongTimeout")
+	}
+	if o.WriteTimeout == nil || *o.WriteTimeout < 1 {
+		panic("Invalid writeTimeout")
+	}
+	if o.SendQueue == nil || *o.SendQueue < 1 {
+		panic("Invalid sendQueue")
+	}
+}
+
+func (o *WebSocketConfig) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if len(o.Origins) == 0 {
+		return host == strings.ToLower(r.Host)
+	}
+	for _, allowed := range o.Origins {
+		if allowed == "*" || strings.ToLower(allowed) == host {
+			return true
+		}
+	}
+	return false
+}
+
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (o wsCloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", o.code, o.reason)
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+type wsMessage struct {
+	opcode byte
+	data   []byte
+}
+
+// WebSocket a server side connection. ReadMessage must be called from a single goroutine, Send can
+// be called from any goroutine.
+type WebSocket struct {
+	Subprotocol string
+	config      WebSocketConfig
+	r           *http.Request
+	conn        net.Conn
+	reader      *bufio.Reader
+	writeMux    *sync.Mutex
+	send        chan wsMessage
+	closing     chan []byte
+	writerDone  chan struct{}
+	closeFrame  bool
+	done        chan struct{}
+	closeOnce   *sync.Once
+	closeMux    *sync.Mutex
+	closeSent   bool
+	closeRecv   bool
+	onClose     []func()
+	closed      bool
+}
+
+// Request the upgrade request, its context carries the values set by the interceptors (i.e. sessionEntry)
+func (o *WebSocket) Request() *http.Request {
+	return o.r
+}
+
+// Done closed once the connection is closing
+func (o *WebSocket) Done() <-chan struct{} {
+	return o.done
+}
+
+// OnClose f runs once the connection is closed, right away when it already is
+func (o *WebSocket) OnClose(f func()) {
+	o.closeMux.Lock()
+	closed := o.closed
+	if !closed {
+		o.onClose = append(o.onClose, f)
+	}
+	o.closeMux.Unlock()
+	if closed {
+		f()
+	}
+}
+
+// ReadMessage blocks until a text or binary message arrives, false once the connection is closing.
+// Control frames are answered here, so reading must go on for pings and closes to be handled.
+func (o *WebSocket) ReadMessage() (int, []byte, bool) {
+	var messageType int
+	var message []byte
+	for {
+		frame, err := o.readFrame()
+		if err != nil {
+			o.fail(err)
+			return 0, nil, false
+		}
+		switch frame.opcode {
+		case wsPing:
+			if o.writeFrame(wsPong, frame.payload) != nil {
+				o.terminate()
+				return 0, nil, false
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			o.receiveClose(frame.payload)
+			return 0, nil, false
+		case WebSocketText, WebSocketBinary:
+			if messageType != 0 {
+				o.fail(wsCloseError{code: WebSocketProtocolError, reason: "Expected continuation frame"})
+				return 0, nil, false
+			}
+			messageType = int(frame.opcode)
+			message = frame.payload
+		case wsContinuation:
+			if messageType == 0 {
+				o.fail(wsCloseError{code: WebSocketProtocolError, reason: "Unexpected continuation frame"})
+				return 0, nil, false
+			}
+			if int64(len(message)+len(frame.payload)) > *o.config.MaxMessageSize {
+				o.fail(wsCloseError{code: WebSocketMessageTooBig, reason: "Message too big"})
+				return 0, nil, false
+			}
+			message = append(message, frame.payload...)
+		default:
+			o.fail(wsCloseError{code: WebSocketProtocolError, reason: "Unknown opcode"})
+			return 0, nil, false
+		}
+		if frame.fin {
+			if messageType == WebSocketText && !utf8.Valid(message) {
+				o.fail(wsCloseError{code: WebSocketInvalidData, reason: "Invalid utf-8"})
+				return 0, nil, false
+			}
+			return messageType, message, true
+		}
+	}
+}
+
+func (o *WebSocket) readFrame() (wsFrame, error) {
+	deadline := time.Duration(*o.config.PingInterval+*o.config.PongTimeout) * time.Second
+	o.closeMux.Lock()
+	if o.closeSent {
+		deadline = time.Duration(*o.config.PongTimeout) * time.Second
+	}
+	o.closeMux.Unlock()
+	if err := o.conn.SetReadDeadline(time.Now().Add(deadline)); err != nil {
+		return wsFrame{}, err
+	}
+	header := make([]byte, 2, 8)
+	if _, err := io.ReadFull(o.reader, header); err != nil {
+		return wsFrame{}, err
+	}
+	frame := wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	if header[0]&0x70 != 0 {
+		return frame, wsCloseError{code: WebSocketProtocolError, reason: "Extensions not supported"}
+	}
+	if header[1]&0x80 == 0 {
+		return frame, wsCloseError{code: WebSocketProtocolError, reason: "Client frames must be masked"}
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(o.reader, header[:2]); err != nil {
+			return frame, err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		header = header[:8]
+		if _, err := io.ReadFull(o.reader, header); err != nil {
+			return frame, err
+		}
+		length = binary.BigEndian.Uint64(header)
+	}
+	if frame.opcode >= wsClose && (length > 125 || !frame.fin) {
+		return frame, wsCloseError{code: WebSocketProtocolError, reason: "Invalid control frame"}
+	}
+	if length > uint64(*o.config.MaxMessageSize) {
+		return frame, wsCloseError{code: WebSocketMessageTooBig, reason: "Message too big"}
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(o.reader, mask); err != nil {
+		return frame, err
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(o.reader, frame.payload); err != nil {
+		return frame, err
+	}
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+	return frame, nil
+}
+
+// writeFrame nothing is written after the close frame
+func (o *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	o.writeMux.Lock()
+	defer o.writeMux.Unlock()
+	if o.closeFrame {
+		return nil
+	}
+	if opcode == wsClose {
+		o.closeFrame = true
+	}
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	err := o.conn.SetWriteDeadline(time.Now().Add(time.Duration(*o.config.WriteTimeout) * time.Second))
+	if err == nil {
+		_, err = o.conn.Write(append(header, payload...))
+	}
+	return err
+}
+
+// Send queues a text or binary message. A full queue means the client does not keep up, the
+// connection is then closed. False once the connection is closing.
+func (o *WebSocket) Send(messageType int, data []byte) bool {
+	o.closeMux.Lock()
+	if o.closeSent {
+		o.closeMux.Unlock()
+		return false
+	}
+	select {
+	case o.send <- wsMessage{opcode: byte(messageType), data: data}:
+		o.closeMux.Unlock()
+		return true
+	default:
+	}
+	o.closeMux.Unlock()
+	util.LogContext(o.r.Context(), "warning").Printf("WebSocket %s send queue full, closing", o.r.URL.Path)
+	o.Close(WebSocketPolicyViolation, "Send queue full")
+	return false
+}
+
+func (o *WebSocket) SendText(s string) bool {
+	return o.Send(WebSocketText, []byte(s))
+}
+
+func (o *WebSocket) SendJson(i interface{}) bool {
+	return o.Send(WebSocketText, util.Marshal(i))
+}
+
+// writeLoop drains the send queue and pings the client. The close frame goes out here once the messages
+// queued before Close are written, a terminated connection drops them.
+func (o *WebSocket) writeLoop(stopping <-chan struct{}) {
+	defer close(o.writerDone)
+	ticker := time.NewTicker(time.Duration(*o.config.PingInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-o.send:
+			if o.writeFrame(m.opcode, m.data) != nil {
+				o.terminate()
+				return
+			}
+		case <-ticker.C:
+			if o.writeFrame(wsPing, nil) != nil {
+				o.terminate()
+				return
+			}
+		case <-stopping:
+			stopping = nil
+			o.Close(WebSocketGoingAway, "Server shutting down")
+		case payload := <-o.closing:
+			o.writeClose(payload)
+			return
+		case <-o.done:
+			// Close queues the frame before closing done
+			select {
+			case payload := <-o.closing:
+				o.writeClose(payload)
+			default:
+			}
+			return
+		}
+	}
+}
+
+func (o *WebSocket) writeClose(payload []byte) {
+	for {
+		select {
+		case m := <-o.send:
+			if o.writeFrame(m.opcode, m.data) != nil {
+				o.terminate()
+				return
+			}
+		default:
+			if o.writeFrame(wsClose, payload) != nil {
+				o.terminate()
+			}
+			return
+		}
+	}
+}
+
+// Close starts the closing handshake, the close frame follows the messages already queued. The connection
+// is released once the client answers or PongTimeout elapses. Reading must go on to receive the answer,
+// ServeWebSocket does it when f returns.
+func (o *WebSocket) Close(code int, reason string) {
+	o.closeMux.Lock()
+	if o.closeSent {
+		o.closeMux.Unlock()
+		return
+	}
+	o.closeSent = true
+	o.closeMux.Unlock()
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload = append(payload, reason...)
+	o.closing <- payload
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+}
+
+func (o *WebSocket) receiveClose(payload []byte) {
+	o.closeMux.Lock()
+	o.closeRecv = true
+	o.closeMux.Unlock()
+	code := WebSocketNormalClosure
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+	}
+	// 1005, 1006 and 1015 are reserved for reporting, they cannot be sent back
+	if code < WebSocketNormalClosure || code == 1005 || code == 1006 || code == 1015 {
+		code = WebSocketProtocolError
+	}
+	o.Close(code, "")
+}
+
+func (o *WebSocket) fail(err error) {
+	var closeError wsCloseError
+	if errors.As(err, &closeError) {
+		util.LogContext(o.r.Context(), "warning").Printf("WebSocket %s: %v", o.r.URL.Path, err)
+		o.Close(closeError.code, closeError.reason)
+		return
+	}
+	o.closeMux.Lock()
+	closing := o.closeSent
+	o.closeMux.Unlock()
+	if !closing && !errors.Is(err, io.EOF) {
+		util.LogContext(o.r.Context(), "debug").Printf("WebSocket %s: %v", o.r.URL.Path, err)
+	}
+	o.terminate()
+}
+
+// terminate drops the connection without the closing handshake
+func (o *WebSocket) terminate() {
+	o.closeMux.Lock()
+	o.closeSent = true
+	o.closeMux.Unlock()
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+	_ = o.conn.Close()
+}
+
+// finish waits for the close frame to be written and for the client one when the server started the
+// handshake, then releases the connection
+func (o *WebSocket) finish() {
+	o.Close(WebSocketNormalClosure, "")
+	<-o.writerDone
+	for {
+		o.closeMux.Lock()
+		received := o.closeRecv
+		o.closeMux.Unlock()
+		if received {
+			break
+		}
+		frame, err := o.readFrame()
+		if err != nil || frame.opcode == wsClose {
+			break
+		}
+	}
+	_ = o.conn.Close()
+	o.closeMux.Lock()
+	hooks := o.onClose
+	o.onClose = nil
+	o.closed = true
+	o.closeMux.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *WebSocketConfig) negotiateSubprotocol(r *http.Request) string {
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, requested := range strings.Split(value, ",") {
+			requested = strings.TrimSpace(requested)
+			for _, supported := range o.Subprotocols {
+				if requested == supported {
+					return supported
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// upgradeWebSocket validates the handshake, failures panic with HttpError so catchFatal can still answer
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, config WebSocketConfig) *WebSocket {
+	if r.Method != http.MethodGet || r.ProtoMajor != 1 {
+		ThrowHttpError(http.StatusBadRequest, "WebSocket upgrade requires HTTP/1.1 GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		ThrowHttpError(http.StatusBadRequest, "Not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		ThrowHttpError(http.StatusUpgradeRequired, "Unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		ThrowHttpError(http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+	}
+	if !config.allowsOrigin(r) {
+		ThrowHttpError(http.StatusForbidden, "Origin not allowed")
+	}
+	subprotocol := config.negotiateSubprotocol(r)
+	conn, buffer, err := http.NewResponseController(w).Hijack()
+	util.CheckErr(err)
+	markStreaming(w, http.StatusSwitchingProtocols)
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if _, err = conn.Write([]byte(response + "\r\n")); err != nil {
+		_ = conn.Close()
+		panic(err)
+	}
+	return &WebSocket{
+		Subprotocol: subprotocol,
+		config:      config,
+		r:           r,
+		conn:        conn,
+		reader:      buffer.Reader,
+		writeMux:    &sync.Mutex{},
+		send:        make(chan wsMessage, *config.SendQueue),
+		closing:     make(chan []byte, 1),
+		writerDone:  make(chan struct{}),
+		done:        make(chan struct{}),
+		closeOnce:   &sync.Once{},
+		closeMux:    &sync.Mutex{},
+	}
+}
+
+// ServeWebSocket upgrades the connection and runs f, the connection is closed when f returns. Panics
+// in f are logged and close the connection with an internal error, like catchFatal does for requests.
+func ServeWebSocket(w http.ResponseWriter, r *http.Request, config WebSocketConfig, f func(ws *WebSocket)) {
+	ws := upgradeWebSocket(w, r, config)
+	route := routeKey(r)
+	stats.PushWebSocket(route, 1)
+	metrics.PushWebSocket(route, 1)
+	defer func() {
+		stats.PushWebSocket(route, -1)
+		metrics.PushWebSocket(route, -1)
+	}()
+	go ws.writeLoop(serverStopping(r))
+	defer ws.finish()
+	defer func() {
+		if e := recover(); e != nil {
+			util.ProcessErrorContext(r.Context(), e, "error")
+			ws.Close(WebSocketInternalError, "Internal error")
+		}
+	}()
+	f(ws)
+}
+
+func InterceptWebSocket(config WebSocketConfig, f func(ws *WebSocket)) http.HandlerFunc {
+	config.Validate()
+	return func(w http.ResponseWriter, r *http.Request) {
+		ServeWebSocket(w, r, config, f)
+	}
+}
+
+func ConfigureWebSocket(serveMux *http.ServeMux, path string, config WebSocketConfig, f func(ws *WebSocket)) {
+	serveMux.HandleFunc(path, InterceptFatal(InterceptWebSocket(config, f)))
+}
+
+// ConfigureWebSocketAuthenticated the token is validated at upgrade, browsers can pass it as the toolkitToken query parameter
+func ConfigureWebSocketAuthenticated(serveMux *http.ServeMux, path string, sessionManager *auth.SessionManager, config WebSocketConfig, f func(ws *WebSocket)) {
+	serveMux.HandleFunc(path, InterceptFatal(InterceptAuth(sessionManager, InterceptWebSocket(config, f))))
+}
+
+// WebSocketHub fans messages out to the connections subscribed to a topic. Connections leave every
+// topic when they close.
+type WebSocketHub struct {
+	mux    *sync.Mutex
+	topics map[string]map[*WebSocket]bool
+	known  map[*WebSocket]bool
+}
+
+func (o *WebSocketHub) Subscribe(topic string, ws *WebSocket) {
+	select {
+	case <-ws.Done():
+		return
+	default:
+	}
+	o.mux.Lock()
+	subscribers, ok := o.topics[topic]
+	if !ok {
+		subscribers = make(map[*WebSocket]bool)
+		o.topics[topic] = subscribers
+	}
+	subscribers[ws] = true
+	known := o.known[ws]
+	o.known[ws] = true
+	o.mux.Unlock()
+	// outside the lock, the hook runs right away when the socket closed in the meantime
+	if !known {
+		ws.OnClose(func() {
+			o.UnsubscribeAll(ws)
+		})
+	}
+}
+
+func (o *WebSocketHub) Unsubscribe(topic string, ws *WebSocket) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.unsubscribe(topic, ws)
+}
+
+func (o *WebSocketHub) unsubscribe(topic string, ws *WebSocket) {
+	subscribers, ok := o.topics[topic]
+	if !ok {
+		return
+	}
+	delete(subscribers, ws)
+	if len(subscribers) == 0 {
+		delete(o.topics, topic)
+	}
+}
+
+func (o *WebSocketHub) UnsubscribeAll(ws *WebSocket) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for topic := range o.topics {
+		o.unsubscribe(topic, ws)
+	}
+	delete(o.known, ws)
+}
+
+// Broadcast returns the number of connections the message was queued for
+func (o *WebSocketHub) Broadcast(topic string, messageType int, data []byte) int {
+	o.mux.Lock()
+	subscribers := make([]*WebSocket, 0, len(o.topics[topic]))
+	for ws := range o.topics[topic] {
+		subscribers = append(subscribers, ws)
+	}
+	o.mux.Unlock()
+	count := 0
+	for _, ws := range subscribers {
+		if ws.Send(messageType, data) {
+			count++
+		}
+	}
+	return count
+}
+
+func (o *WebSocketHub) BroadcastJson(topic string, i interface{}) int {
+	return o.Broadcast(topic, WebSocketText, util.Marshal(i))
+}
+
+func NewWebSocketHub() *WebSocketHub {
+	return &WebSocketHub{
+		mux:    &sync.Mutex{},
+		topics: make(map[string]map[*WebSocket]bool),
+		known:  make(map[*WebSocket]bool),
+	}
+}
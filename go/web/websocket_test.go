@@ -0,0 +1,197 @@
+package web_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sparrowhawktech/toolkit/web"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(header))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	host := strings.TrimPrefix(server.URL, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if origin != "" {
+		request += "Origin: " + origin + "\r\n"
+	}
+	if _, err = conn.Write([]byte(request + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+func TestWebSocket(t *testing.T) {
+	hub := web.NewWebSocketHub()
+	mux := http.NewServeMux()
+	web.ConfigureWebSocket(mux, "/ws", web.DefaultWebSocketConfig(), func(ws *web.WebSocket) {
+		hub.Subscribe("echo", ws)
+		for {
+			messageType, message, ok := ws.ReadMessage()
+			if !ok {
+				return
+			}
+			if string(message) == "panic" {
+				panic("Handler failure")
+			}
+			hub.Broadcast("echo", messageType, message)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, reader, response := dialWebSocket(t, server, "/ws", "")
+		if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Fatalf("Unexpected handshake %d %v", response.StatusCode, response.Header)
+		}
+		return conn, reader
+	}
+
+	conn, reader := dial()
+	defer conn.Close()
+	writeClientFrame(t, conn, 9, []byte("ping"))
+	if opcode, payload := readServerFrame(t, reader); opcode != 10 || string(payload) != "ping" {
+		t.Fatalf("Expected pong, got %d %q", opcode, payload)
+	}
+	writeClientFrame(t, conn, web.WebSocketText, []byte("hello"))
+	if opcode, payload := readServerFrame(t, reader); opcode != web.WebSocketText || string(payload) != "hello" {
+		t.Fatalf("Expected echo, got %d %q", opcode, payload)
+	}
+	writeClientFrame(t, conn, 8, binary.BigEndian.AppendUint16(nil, 1000))
+	if opcode, payload := readServerFrame(t, reader); opcode != 8 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Fatalf("Expected close, got %d %q", opcode, payload)
+	}
+
+	failing, failingReader := dial()
+	defer failing.Close()
+	writeClientFrame(t, failing, web.WebSocketText, []byte("panic"))
+	opcode, payload := readServerFrame(t, failingReader)
+	if opcode != 8 || binary.BigEndian.Uint16(payload) != web.WebSocketInternalError {
+		t.Fatalf("Expected internal error close, got %d %q", opcode, payload)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	mux := http.NewServeMux()
+	web.ConfigureWebSocket(mux, "/ws", web.DefaultWebSocketConfig(), func(ws *web.WebSocket) {
+		for i := 0; i < 50; i++ {
+			ws.SendText(strconv.Itoa(i))
+		}
+		ws.Close(web.WebSocketNormalClosure, "bye")
+		if ws.SendText("late") {
+			t.Error("Message accepted after close")
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn, reader, _ := dialWebSocket(t, server, "/ws", "")
+	defer conn.Close()
+	for i := 0; i < 50; i++ {
+		if opcode, payload := readServerFrame(t, reader); opcode != web.WebSocketText || string(payload) != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, got %d %q", i, opcode, payload)
+		}
+	}
+	if opcode, payload := readServerFrame(t, reader); opcode != 8 || string(payload[2:]) != "bye" {
+		t.Fatalf("Expected close, got %d %q", opcode, payload)
+	}
+	writeClientFrame(t, conn, 8, binary.BigEndian.AppendUint16(nil, 1000))
+	if n, err := reader.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("Data after the close frame")
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	config := web.DefaultWebSocketConfig()
+	config.Origins = []string{"app.example.com"}
+	mux := http.NewServeMux()
+	web.ConfigureWebSocket(mux, "/ws", config, func(ws *web.WebSocket) {})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cases := map[string]int{
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"https://evil.example.com": http.StatusForbidden,
+		"x":                        http.StatusForbidden,
+		"app.example.com":          http.StatusForbidden,
+		"null":                     http.StatusForbidden,
+	}
+	for origin, status := range cases {
+		conn, _, response := dialWebSocket(t, server, "/ws", origin)
+		conn.Close()
+		if response.StatusCode != status {
+			t.Fatalf("Unexpected status %d for origin %q, expected %d", response.StatusCode, origin, status)
+		}
+	}
+}
+
+func TestWebSocketOnClose(t *testing.T) {
+	sockets := make(chan *web.WebSocket, 1)
+	closed := make(chan struct{})
+	mux := http.NewServeMux()
+	web.ConfigureWebSocket(mux, "/ws", web.DefaultWebSocketConfig(), func(ws *web.WebSocket) {
+		ws.OnClose(func() { close(closed) })
+		sockets <- ws
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn, _, _ := dialWebSocket(t, server, "/ws", "")
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hook not run")
+	}
+	// hooks added once the socket is closed run right away, so i.e. hubs never keep closed sockets
+	ran := false
+	(<-sockets).OnClose(func() { ran = true })
+	if !ran {
+		t.Fatal("Hook added after close not run")
+	}
+}